@@ -0,0 +1,191 @@
+// Package admission decides which remote peers may listen to media-peer: peers
+// on an allowlist, peers that know the PIN and peers an operator approves.
+package admission
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gurupras/dhwani_backend_p2p/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrWrongPIN        = errors.New("wrong PIN")
+	ErrNotAllowed      = errors.New("not allowed")
+	ErrRejected        = errors.New("rejected by the operator")
+	ErrApprovalExpired = errors.New("no operator approved in time")
+	ErrSuperseded      = errors.New("superseded by a newer offer")
+	ErrWithdrawn       = errors.New("withdrawn by the peer")
+)
+
+// Options configure a Policy
+type Options struct {
+	// Allow lists peers that are admitted without a PIN or approval
+	Allow []string
+	// PIN, if set, must be in the offer of every peer not on the allowlist
+	PIN string
+	// Approve holds peers not on the allowlist until an operator decides
+	Approve bool
+	// ApprovalTimeout rejects requests nobody decided on. 0 waits forever
+	ApprovalTimeout time.Duration
+}
+
+// Pending is a request awaiting an operator's decision
+type Pending struct {
+	peer.AdmissionRequest
+	Since time.Time `json:"since"`
+
+	decide func(err error)
+	timer  *time.Timer
+}
+
+// Policy admits peers according to its Options. With no allowlist, PIN or
+// approval every peer is admitted.
+type Policy struct {
+	options Options
+	allowed map[string]bool
+
+	mutex     sync.Mutex
+	pending   map[string]*Pending
+	onPending func(req Pending)
+}
+
+func NewPolicy(options Options) *Policy {
+	allowed := make(map[string]bool)
+	for _, id := range options.Allow {
+		allowed[id] = true
+	}
+	return &Policy{
+		options: options,
+		allowed: allowed,
+		pending: make(map[string]*Pending),
+	}
+}
+
+// OnPending registers cb to be told about every request that awaits approval
+func (p *Policy) OnPending(cb func(req Pending)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.onPending = cb
+}
+
+// Admit implements peer.Admit
+func (p *Policy) Admit(req peer.AdmissionRequest, decide func(err error)) {
+	if p.allowed[req.RemoteID] {
+		decide(nil)
+		return
+	}
+	if p.options.PIN != "" && subtle.ConstantTimeCompare([]byte(req.PIN), []byte(p.options.PIN)) != 1 {
+		decide(ErrWrongPIN)
+		return
+	}
+	if p.options.Approve {
+		p.hold(req, decide)
+		return
+	}
+	if p.options.PIN == "" && len(p.allowed) > 0 {
+		decide(ErrNotAllowed)
+		return
+	}
+	decide(nil)
+}
+
+// hold keeps req until an operator decides on it
+func (p *Policy) hold(req peer.AdmissionRequest, decide func(err error)) {
+	pending := &Pending{
+		AdmissionRequest: req,
+		Since:            time.Now(),
+		decide:           decide,
+	}
+	p.mutex.Lock()
+	previous := p.pending[req.RemoteID]
+	p.pending[req.RemoteID] = pending
+	if p.options.ApprovalTimeout > 0 {
+		pending.timer = time.AfterFunc(p.options.ApprovalTimeout, func() {
+			if p.take(req.RemoteID, pending) {
+				log.Infof("Nobody decided on '%v' in time\n", req.RemoteID)
+				decide(ErrApprovalExpired)
+			}
+		})
+	}
+	onPending := p.onPending
+	p.mutex.Unlock()
+	if req.Done != nil {
+		go func() {
+			<-req.Done
+			if p.take(req.RemoteID, pending) {
+				pending.stop()
+				log.Infof("'%v' stopped waiting for approval\n", req.RemoteID)
+				decide(ErrWithdrawn)
+			}
+		}()
+	}
+
+	if previous != nil {
+		previous.stop()
+		previous.decide(ErrSuperseded)
+	}
+	log.Infof("'%v' is waiting for approval\n", req.RemoteID)
+	if onPending != nil {
+		onPending(*pending)
+	}
+}
+
+// take removes pending if it is still the request of remoteID
+func (p *Policy) take(remoteID string, pending *Pending) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.pending[remoteID] != pending {
+		return false
+	}
+	delete(p.pending, remoteID)
+	return true
+}
+
+func (r *Pending) stop() {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+}
+
+// Pending lists the requests awaiting approval, oldest first
+func (p *Policy) Pending() []Pending {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	result := make([]Pending, 0, len(p.pending))
+	for _, pending := range p.pending {
+		result = append(result, *pending)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Since.Before(result[j].Since)
+	})
+	return result
+}
+
+// Approve admits the pending request of remoteID
+func (p *Policy) Approve(remoteID string) error {
+	return p.resolve(remoteID, nil)
+}
+
+// Reject refuses the pending request of remoteID
+func (p *Policy) Reject(remoteID string) error {
+	return p.resolve(remoteID, ErrRejected)
+}
+
+func (p *Policy) resolve(remoteID string, err error) error {
+	p.mutex.Lock()
+	pending, ok := p.pending[remoteID]
+	delete(p.pending, remoteID)
+	p.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("no pending request from '%v'", remoteID)
+	}
+	pending.stop()
+	pending.decide(err)
+	return nil
+}
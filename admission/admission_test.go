@@ -0,0 +1,91 @@
+package admission
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gurupras/dhwani_backend_p2p/peer"
+	"github.com/stretchr/testify/require"
+)
+
+// decision records what a Policy decided
+type decision chan error
+
+func (d decision) decide(err error) {
+	d <- err
+}
+
+func (d decision) wait(t *testing.T) error {
+	select {
+	case err := <-d:
+		return err
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "no decision")
+	}
+	return nil
+}
+
+func TestPolicy(t *testing.T) {
+	require := require.New(t)
+
+	admit := func(p *Policy, id, pin string) error {
+		d := make(decision, 1)
+		p.Admit(peer.AdmissionRequest{RemoteID: id, PIN: pin}, d.decide)
+		return d.wait(t)
+	}
+
+	open := NewPolicy(Options{})
+	require.Nil(admit(open, "anyone", ""))
+
+	allowlist := NewPolicy(Options{Allow: []string{"friend"}})
+	require.Nil(admit(allowlist, "friend", ""))
+	require.Equal(ErrNotAllowed, admit(allowlist, "stranger", ""))
+
+	pin := NewPolicy(Options{Allow: []string{"friend"}, PIN: "1234"})
+	require.Nil(admit(pin, "friend", ""))
+	require.Nil(admit(pin, "stranger", "1234"))
+	require.Equal(ErrWrongPIN, admit(pin, "stranger", "0000"))
+}
+
+func TestApproval(t *testing.T) {
+	require := require.New(t)
+
+	p := NewPolicy(Options{Approve: true, ApprovalTimeout: 100 * time.Millisecond})
+	held := make(chan Pending, 10)
+	p.OnPending(func(req Pending) {
+		held <- req
+	})
+
+	first := make(decision, 1)
+	p.Admit(peer.AdmissionRequest{RemoteID: "listener"}, first.decide)
+	require.Equal("listener", (<-held).RemoteID)
+	require.Len(p.Pending(), 1)
+
+	// A newer offer replaces the one waiting
+	second := make(decision, 1)
+	p.Admit(peer.AdmissionRequest{RemoteID: "listener"}, second.decide)
+	require.Equal(ErrSuperseded, first.wait(t))
+	require.Len(p.Pending(), 1)
+	require.Nil(p.Approve("listener"))
+	require.Nil(second.wait(t))
+	require.NotNil(p.Approve("listener"))
+
+	rejected := make(decision, 1)
+	p.Admit(peer.AdmissionRequest{RemoteID: "other"}, rejected.decide)
+	require.Nil(p.Reject("other"))
+	require.Equal(ErrRejected, rejected.wait(t))
+
+	expired := make(decision, 1)
+	p.Admit(peer.AdmissionRequest{RemoteID: "late"}, expired.decide)
+	require.Equal(ErrApprovalExpired, expired.wait(t))
+	require.Empty(p.Pending())
+
+	// Requests whose peer gave up are withdrawn
+	done := make(chan struct{})
+	withdrawn := make(decision, 1)
+	p.Admit(peer.AdmissionRequest{RemoteID: "impatient", Done: done}, withdrawn.decide)
+	require.Len(p.Pending(), 1)
+	close(done)
+	require.Equal(ErrWithdrawn, withdrawn.wait(t))
+	require.Empty(p.Pending())
+}
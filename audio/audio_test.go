@@ -65,3 +65,34 @@ func TestEncodeOpus(t *testing.T) {
 	wg.Wait()
 	require.True(gotBytes)
 }
+
+func TestMixer(t *testing.T) {
+	require := require.New(t)
+
+	m := NewMixer(2, 4)
+	m.Write("a", []int16{100, 100, 200, 200})
+	m.Write("b", []int16{30000, 30000})
+	m.SetVolume("a", 0.5)
+	require.Equal(0.5, m.Volume("a"))
+	require.Equal(2, m.Buffered("a"))
+
+	out := make([]int16, 6)
+	m.Read(out)
+	// a plays at half volume over b. b runs out after one frame and a after two
+	require.Equal([]int16{30050, 30050, 100, 100, 0, 0}, out)
+	require.Equal(0, m.Buffered("a"))
+
+	// Only the most recent frames are kept
+	m.Write("b", []int16{1, 1, 2, 2, 3, 3, 4, 4, 5, 5})
+	require.Equal(4, m.Buffered("b"))
+	m.Remove("a")
+	m.Read(out[:2])
+	require.Equal([]int16{2, 2}, out[:2])
+
+	m.Write("c", []int16{32767, 32767})
+	m.Write("b", []int16{32767, 32767})
+	m.Remove("b")
+	m.Write("b", []int16{32767, 32767})
+	m.Read(out[:2])
+	require.Equal([]int16{32767, 32767}, out[:2])
+}
@@ -0,0 +1,111 @@
+package audio
+
+import (
+	"math"
+	"sync"
+)
+
+// Mixer sums interleaved 16-bit PCM from several inputs, each with its own volume
+type Mixer struct {
+	mutex      sync.Mutex
+	channels   int
+	maxSamples int
+	inputs     map[string]*mixerInput
+}
+
+type mixerInput struct {
+	samples []int16
+	volume  float64
+}
+
+// NewMixer creates a mixer for channels interleaved channels that buffers at
+// most maxFrames frames per input, dropping the oldest beyond that
+func NewMixer(channels int, maxFrames int) *Mixer {
+	return &Mixer{
+		channels:   channels,
+		maxSamples: channels * maxFrames,
+		inputs:     make(map[string]*mixerInput),
+	}
+}
+
+func (m *Mixer) input(id string) *mixerInput {
+	input, ok := m.inputs[id]
+	if !ok {
+		input = &mixerInput{volume: 1}
+		m.inputs[id] = input
+	}
+	return input
+}
+
+// Write queues pcm from input id
+func (m *Mixer) Write(id string, pcm []int16) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	input := m.input(id)
+	input.samples = append(input.samples, pcm...)
+	if excess := len(input.samples) - m.maxSamples; excess > 0 {
+		// Keep the whole frames that are most recent
+		excess += (m.channels - excess%m.channels) % m.channels
+		input.samples = input.samples[excess:]
+	}
+}
+
+// SetVolume scales input id. 1 leaves it unchanged and 0 mutes it
+func (m *Mixer) SetVolume(id string, volume float64) {
+	if volume < 0 {
+		volume = 0
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.input(id).volume = volume
+}
+
+// Volume returns the volume of input id
+func (m *Mixer) Volume(id string) float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if input, ok := m.inputs[id]; ok {
+		return input.volume
+	}
+	return 1
+}
+
+// Remove drops input id and whatever it had queued
+func (m *Mixer) Remove(id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.inputs, id)
+}
+
+// Buffered returns the number of frames queued for input id
+func (m *Mixer) Buffered(id string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if input, ok := m.inputs[id]; ok {
+		return len(input.samples) / m.channels
+	}
+	return 0
+}
+
+// Read fills out with the mix of every input. Inputs that run short are
+// treated as silence.
+func (m *Mixer) Read(out []int16) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for idx := range out {
+		sum := 0.0
+		for _, input := range m.inputs {
+			if idx < len(input.samples) {
+				sum += float64(input.samples[idx]) * input.volume
+			}
+		}
+		out[idx] = int16(math.Max(math.MinInt16, math.Min(math.MaxInt16, sum)))
+	}
+	for _, input := range m.inputs {
+		if len(out) >= len(input.samples) {
+			input.samples = input.samples[:0]
+		} else {
+			input.samples = input.samples[len(out):]
+		}
+	}
+}
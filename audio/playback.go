@@ -0,0 +1,225 @@
+package audio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	soundio "github.com/crow-misia/go-libsoundio"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/hraban/opus.v2"
+)
+
+// opusFrameDuration is the longest frame we decode in one go
+const opusFrameDuration = 60 * time.Millisecond
+
+// Sample rates the Opus decoder can produce, in order of preference
+var opusSampleRates = []int{
+	48000,
+	24000,
+	16000,
+	12000,
+	8000,
+}
+
+// Player plays remote Opus streams on an output device, mixed together
+type Player struct {
+	*Mixer
+	outStream  *soundio.OutStream
+	device     *soundio.Device
+	SampleRate int
+	// Channels is the number of channels we decode and mix. The device may have more
+	Channels int
+	mutex    sync.Mutex
+	inputs   map[string]*PlayerInput
+}
+
+// Play opens the output device with the given identifier, or the default
+// output device if it is empty. buffer bounds how much audio is queued per
+// input before the oldest is dropped.
+func (a *Audio) Play(deviceIdentifier string, buffer time.Duration) (*Player, error) {
+	var selectedDevice *soundio.Device
+	if deviceIdentifier == "" {
+		selectedDevice = a.OutputDevice(a.DefaultOutputDeviceIndex())
+	} else {
+		count := a.OutputDeviceCount()
+		for i := 0; i < count; i++ {
+			device := a.OutputDevice(i)
+			if device.ID() == deviceIdentifier {
+				selectedDevice = device
+				break
+			}
+			device.RemoveReference()
+		}
+	}
+	if selectedDevice == nil {
+		return nil, fmt.Errorf("failed to find device: '%v'", deviceIdentifier)
+	}
+
+	if !selectedDevice.SupportsFormat(soundio.FormatS16LE) {
+		selectedDevice.RemoveReference()
+		return nil, fmt.Errorf("device '%v' does not support %v", deviceIdentifier, soundio.FormatS16LE)
+	}
+	sampleRate := 0
+	for _, rate := range opusSampleRates {
+		if selectedDevice.SupportsSampleRate(rate) {
+			sampleRate = rate
+			break
+		}
+	}
+	if sampleRate == 0 {
+		selectedDevice.RemoveReference()
+		return nil, fmt.Errorf("device '%v' supports no sample rate Opus can decode to", deviceIdentifier)
+	}
+
+	layout := selectedDevice.CurrentLayout()
+	outStream, err := selectedDevice.NewOutStream(&soundio.OutStreamConfig{
+		Format:     soundio.FormatS16LE,
+		SampleRate: sampleRate,
+		Layout:     layout,
+		Name:       "dhwani",
+	})
+	if err != nil {
+		selectedDevice.RemoveReference()
+		return nil, fmt.Errorf("unable to open output device: %s", err)
+	}
+
+	deviceChannels := outStream.Layout().ChannelCount()
+	channels := 2
+	if deviceChannels < 2 {
+		channels = 1
+	}
+	log.Debugf("Playing on '%v' at %vHz with %v channels\n", selectedDevice.Name(), sampleRate, deviceChannels)
+
+	ret := &Player{
+		Mixer:      NewMixer(channels, int(buffer.Seconds()*float64(sampleRate))),
+		outStream:  outStream,
+		device:     selectedDevice,
+		SampleRate: sampleRate,
+		Channels:   channels,
+		inputs:     make(map[string]*PlayerInput),
+	}
+
+	var mixed []int16
+	outStream.SetWriteCallback(func(stream *soundio.OutStream, frameCountMin int, frameCountMax int) {
+		framesLeft := frameCountMax
+		for framesLeft > 0 {
+			frameCount := framesLeft
+			areas, err := stream.BeginWrite(&frameCount)
+			if err != nil {
+				log.Errorf("begin write error: %s", err)
+				return
+			}
+			if frameCount <= 0 {
+				break
+			}
+			if cap(mixed) < frameCount*channels {
+				mixed = make([]int16, frameCount*channels)
+			}
+			mixed = mixed[:frameCount*channels]
+			ret.Read(mixed)
+			for frame := 0; frame < frameCount; frame++ {
+				for ch := 0; ch < deviceChannels; ch++ {
+					sample := int16(0)
+					if ch < channels {
+						sample = mixed[frame*channels+ch]
+					}
+					binary.LittleEndian.PutUint16(areas.Buffer(ch, frame), uint16(sample))
+				}
+			}
+			if err := stream.EndWrite(); err != nil {
+				log.Errorf("end write error: %s", err)
+				return
+			}
+			framesLeft -= frameCount
+		}
+	})
+	outStream.SetUnderflowCallback(func(stream *soundio.OutStream) {
+		log.Debugf("Playback underflow\n")
+	})
+	if err := outStream.Start(); err != nil {
+		outStream.Destroy()
+		selectedDevice.RemoveReference()
+		return nil, fmt.Errorf("unable to start output device: %s", err)
+	}
+	return ret, nil
+}
+
+// Input returns the input called id, creating it if needed
+func (p *Player) Input(id string) (*PlayerInput, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if input, ok := p.inputs[id]; ok {
+		return input, nil
+	}
+	decoder, err := opus.NewDecoder(p.SampleRate, p.Channels)
+	if err != nil {
+		return nil, err
+	}
+	input := &PlayerInput{
+		id:      id,
+		player:  p,
+		decoder: decoder,
+		pcm:     make([]int16, int(opusFrameDuration.Seconds()*float64(p.SampleRate))*p.Channels),
+	}
+	p.inputs[id] = input
+	return input, nil
+}
+
+// Stop closes the output device
+func (p *Player) Stop() error {
+	p.mutex.Lock()
+	p.inputs = make(map[string]*PlayerInput)
+	p.mutex.Unlock()
+	p.outStream.Destroy()
+	p.device.RemoveReference()
+	return nil
+}
+
+// PlayerInput decodes one remote Opus stream into its Player
+type PlayerInput struct {
+	id      string
+	player  *Player
+	decoder *opus.Decoder
+	pcm     []int16
+	// frames is the length of the last decoded packet, used to size concealment
+	frames int
+}
+
+// WriteOpus decodes an Opus packet and queues it for playback
+func (i *PlayerInput) WriteOpus(payload []byte) error {
+	n, err := i.decoder.Decode(payload, i.pcm)
+	if err != nil {
+		return err
+	}
+	i.frames = n
+	i.player.Write(i.id, i.pcm[:n*i.player.Channels])
+	return nil
+}
+
+// Conceal fills in for a lost packet
+func (i *PlayerInput) Conceal() error {
+	if i.frames == 0 {
+		return nil
+	}
+	pcm := i.pcm[:i.frames*i.player.Channels]
+	if err := i.decoder.DecodePLC(pcm); err != nil {
+		return err
+	}
+	i.player.Write(i.id, pcm)
+	return nil
+}
+
+// SetVolume scales this input. 1 leaves it unchanged and 0 mutes it
+func (i *PlayerInput) SetVolume(volume float64) {
+	i.player.SetVolume(i.id, volume)
+}
+
+// Close stops playing this input
+func (i *PlayerInput) Close() {
+	i.player.mutex.Lock()
+	delete(i.player.inputs, i.id)
+	i.player.mutex.Unlock()
+	i.player.Remove(i.id)
+}
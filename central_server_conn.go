@@ -1,23 +1,123 @@
 package dhwani_backend_p2p
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
 	"net/url"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/recws-org/recws"
 	log "github.com/sirupsen/logrus"
 )
 
 const SERVER_HOST = "dhwani-backend.gurupras.me"
 
+const (
+	defaultServerPath  = "/ws"
+	defaultDialTimeout = 10 * time.Second
+	defaultAckTimeout  = 10 * time.Second
+	defaultQueueSize   = 64
+
+	defaultHeartbeatTimeout = 5 * time.Second
+)
+
+// ServerOptions describes how to reach the signaling server
+type ServerOptions struct {
+	// URL is the base URL of the signaling server, e.g. wss://example.com.
+	// Defaults to wss://SERVER_HOST
+	URL string
+	// Path of the websocket endpoint. Defaults to /ws
+	Path string
+	// Header holds extra headers sent with the websocket handshake
+	Header http.Header
+	// TLSConfig is used for wss:// connections (custom CAs, client certificates)
+	TLSConfig *tls.Config
+	// DialTimeout bounds the websocket handshake. Defaults to 10s
+	DialTimeout time.Duration
+	// Acks makes SendSignal wait for the server to acknowledge every signal,
+	// so that undeliverable signals are reported. Only servers that send acks,
+	// such as package signalserver, support it
+	Acks bool
+	// AckTimeout bounds how long requests wait for the server when the
+	// caller's context has no deadline. Defaults to 10s
+	AckTimeout time.Duration
+	// AutoReconnect keeps redialing the server whenever the connection drops
+	AutoReconnect bool
+	// Backoff controls the delay between reconnection attempts
+	Backoff Backoff
+	// QueueSize bounds how many outbound messages are held while
+	// reconnecting. Defaults to 64
+	QueueSize int
+	// HeartbeatInterval, if positive, is how often Loop pings the server. Only
+	// servers that answer pings, such as package signalserver, support it
+	HeartbeatInterval time.Duration
+	// HeartbeatTimeout is how long to wait for a pong before the connection
+	// is considered dead and torn down. Defaults to 5s
+	HeartbeatTimeout time.Duration
+}
+
+// DefaultServerOptions returns the options used to reach the public signaling
+// server. It neither acks signals nor answers pings
+func DefaultServerOptions() ServerOptions {
+	return ServerOptions{
+		URL:         "wss://" + SERVER_HOST,
+		Path:        defaultServerPath,
+		DialTimeout: defaultDialTimeout,
+		AckTimeout:  defaultAckTimeout,
+		Backoff:     DefaultBackoff(),
+		QueueSize:   defaultQueueSize,
+	}
+}
+
+func (o ServerOptions) endpoint(id string) (*url.URL, error) {
+	rawURL := o.URL
+	if rawURL == "" {
+		rawURL = "wss://" + SERVER_HOST
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL '%v': %w", rawURL, err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("invalid server URL '%v': scheme must be ws or wss", rawURL)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid server URL '%v': missing host", rawURL)
+	}
+	if o.Path != "" {
+		u.Path = o.Path
+	} else if u.Path == "" {
+		u.Path = defaultServerPath
+	}
+	q := u.Query()
+	q.Set("id", id)
+	u.RawQuery = q.Encode()
+	return u, nil
+}
+
 type SignalPacket struct {
 	From string `json:"from"`
 	To   string `json:"to"`
 	Type string `json:"type"`
 	Data string `json:"data"`
+	// Sealed is set when Data is encrypted end to end between the peers
+	Sealed bool `json:"sealed,omitempty"`
+}
+
+// PacketSealer protects SignalPacket.Data end to end between peers.
+// See package e2e.
+type PacketSealer interface {
+	// Seal encrypts sp for sp.To
+	Seal(sp SignalPacket) (SignalPacket, error)
+	// Open verifies the sender of sp and decrypts it
+	Open(sp SignalPacket) (SignalPacket, error)
 }
 
 type ServerConnection interface {
@@ -26,22 +126,205 @@ type ServerConnection interface {
 	Close() error
 }
 
-type reconnectingConnWrapper struct {
-	*recws.RecConn
+// ActionHandler handles the raw JSON of a message with a given action
+type ActionHandler func(raw json.RawMessage) error
+
+type actionCallback struct {
+	cb ActionHandler
 }
 
-func (r *reconnectingConnWrapper) Close() error {
-	r.RecConn.Close()
-	return nil
+type signalCallback struct {
+	cb func(SignalPacket)
+}
+
+type errorCallback struct {
+	cb func(error)
+}
+
+type stateCallback struct {
+	cb func(ConnState)
+}
+
+type reconnectCallback struct {
+	cb func()
+}
+
+type queuedMessage struct {
+	messageType int
+	data        []byte
 }
 
 type ServerConn struct {
 	ServerConnection
-	signalCallbacks []func(SignalPacket)
-	wg              sync.WaitGroup
-	mutex           sync.Mutex
-	started         bool
-	stopped         bool
+	id              string
+	acks            bool
+	ackTimeout      time.Duration
+	actionCallbacks map[string][]*actionCallback
+	signalCallbacks []*signalCallback
+	errorCallbacks  []*errorCallback
+	pending         map[string]chan reply
+	rooms           map[string]struct{}
+	sealer          PacketSealer
+	state           ConnState
+	everConnected   bool
+	stateCallbacks  []*stateCallback
+	reconnectHooks  []*reconnectCallback
+	// queue holds messages written while reconnecting. It is nil when the
+	// connection cannot reconnect.
+	queue      []queuedMessage
+	queueSize  int
+	heartbeat  heartbeatConfig
+	rtt        time.Duration
+	mutex      sync.Mutex
+	writeMutex sync.Mutex
+	runDone    chan struct{}
+	started    bool
+	stopped    bool
+}
+
+// ID returns the ID this connection registered with
+func (s *ServerConn) ID() string {
+	return s.id
+}
+
+// WriteMessage serializes writes; the underlying websocket allows only one writer at a time.
+// While an auto-reconnecting connection is down, messages are queued and
+// flushed once it is back.
+func (s *ServerConn) WriteMessage(messageType int, data []byte) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	if s.queueSize > 0 && s.State() != StateConnected {
+		return s.enqueue(messageType, data)
+	}
+	err := s.ServerConnection.WriteMessage(messageType, data)
+	if s.queueSize > 0 && errors.Is(err, ErrNotConnected) {
+		return s.enqueue(messageType, data)
+	}
+	return err
+}
+
+// enqueue must be called with writeMutex held
+func (s *ServerConn) enqueue(messageType int, data []byte) error {
+	if len(s.queue) >= s.queueSize {
+		return ErrQueueFull
+	}
+	s.queue = append(s.queue, queuedMessage{messageType, data})
+	return nil
+}
+
+// State returns the current state of the connection
+func (s *ServerConn) State() ConnState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state
+}
+
+// OnStateChange registers cb for connection state changes.
+// The returned function unregisters it.
+func (s *ServerConn) OnStateChange(cb func(ConnState)) func() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry := &stateCallback{cb}
+	s.stateCallbacks = append(s.stateCallbacks, entry)
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		for idx, c := range s.stateCallbacks {
+			if c == entry {
+				s.stateCallbacks = append(s.stateCallbacks[:idx:idx], s.stateCallbacks[idx+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// OnReconnect registers cb to run every time the connection comes back after
+// being lost, once queued messages are flushed and rooms are rejoined. Use
+// it to re-announce ourselves to peers. cb runs on its own goroutine and may
+// block on replies from the server.
+// The returned function unregisters it.
+func (s *ServerConn) OnReconnect(cb func()) func() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry := &reconnectCallback{cb}
+	s.reconnectHooks = append(s.reconnectHooks, entry)
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		for idx, c := range s.reconnectHooks {
+			if c == entry {
+				s.reconnectHooks = append(s.reconnectHooks[:idx:idx], s.reconnectHooks[idx+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (s *ServerConn) setState(state ConnState) {
+	s.mutex.Lock()
+	if s.state == state {
+		s.mutex.Unlock()
+		return
+	}
+	s.state = state
+	callbacks := append([]*stateCallback(nil), s.stateCallbacks...)
+	s.mutex.Unlock()
+	log.Debugf("Server connection state: %v\n", state)
+	for _, c := range callbacks {
+		c.cb(state)
+	}
+}
+
+// handleConnState is invoked by a reconnecting connection whenever its state changes
+func (s *ServerConn) handleConnState(state ConnState) {
+	if state != StateConnected {
+		s.setState(state)
+		return
+	}
+	// Flush before anyone else gets to write so that ordering is preserved
+	s.writeMutex.Lock()
+	s.mutex.Lock()
+	s.state = StateConnected
+	reconnected := s.everConnected
+	s.everConnected = true
+	callbacks := append([]*stateCallback(nil), s.stateCallbacks...)
+	s.mutex.Unlock()
+	queue := s.queue
+	s.queue = nil
+	for idx, msg := range queue {
+		if err := s.ServerConnection.WriteMessage(msg.messageType, msg.data); err != nil {
+			log.Warnf("Failed to flush queued messages: %v\n", err)
+			s.queue = append(s.queue, queue[idx:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		log.Debugf("Flushed %v queued messages\n", len(queue)-len(s.queue))
+	}
+	s.writeMutex.Unlock()
+
+	log.Debugf("Server connection state: %v\n", state)
+	for _, c := range callbacks {
+		c.cb(state)
+	}
+	if reconnected {
+		go s.reregister()
+	}
+}
+
+// reregister restores server-side state after a reconnect
+func (s *ServerConn) reregister() {
+	for _, room := range s.Rooms() {
+		if _, err := s.JoinRoom(context.Background(), room); err != nil {
+			s.reportError(fmt.Errorf("failed to rejoin room '%v': %w", room, err))
+		}
+	}
+	s.mutex.Lock()
+	hooks := append([]*reconnectCallback(nil), s.reconnectHooks...)
+	s.mutex.Unlock()
+	for _, h := range hooks {
+		h.cb()
+	}
 }
 
 func (s *ServerConn) Close() error {
@@ -49,112 +332,461 @@ func (s *ServerConn) Close() error {
 	return nil
 }
 
+// OnAction registers cb for every message whose action is action.
+// The returned function unregisters it.
+func (s *ServerConn) OnAction(action string, cb ActionHandler) func() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry := &actionCallback{cb}
+	s.actionCallbacks[action] = append(s.actionCallbacks[action], entry)
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		callbacks := s.actionCallbacks[action]
+		for idx, c := range callbacks {
+			if c == entry {
+				s.actionCallbacks[action] = append(callbacks[:idx:idx], callbacks[idx+1:]...)
+				log.Debugf("Removed '%v' callback", action)
+				break
+			}
+		}
+	}
+}
+
+// OnError registers cb for messages that could not be decoded or handled.
+// Errors are logged when no error callback is registered.
+func (s *ServerConn) OnError(cb func(error)) func() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry := &errorCallback{cb}
+	s.errorCallbacks = append(s.errorCallbacks, entry)
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		for idx, c := range s.errorCallbacks {
+			if c == entry {
+				s.errorCallbacks = append(s.errorCallbacks[:idx:idx], s.errorCallbacks[idx+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// SetSealer makes SendSignal seal and OnSignal open packets with sealer.
+// Packets that fail to open are reported through OnError and dropped.
+func (s *ServerConn) SetSealer(sealer PacketSealer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sealer = sealer
+}
+
+func (s *ServerConn) getSealer() PacketSealer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sealer
+}
+
+// OnSignal registers cb for signals from other peers. The returned function
+// unregisters it.
 func (s *ServerConn) OnSignal(cb func(SignalPacket)) func() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	length := len(s.signalCallbacks)
-	s.signalCallbacks = append(s.signalCallbacks, cb)
+	entry := &signalCallback{cb}
+	s.signalCallbacks = append(s.signalCallbacks, entry)
 	return func() {
 		s.mutex.Lock()
 		defer s.mutex.Unlock()
-		s.signalCallbacks = append(s.signalCallbacks[:length], s.signalCallbacks[length+1:]...)
-		log.Debugf("Removed signal callback")
+		for idx, c := range s.signalCallbacks {
+			if c == entry {
+				s.signalCallbacks = append(s.signalCallbacks[:idx:idx], s.signalCallbacks[idx+1:]...)
+				break
+			}
+		}
 	}
 }
 
-func (s *ServerConn) Loop() {
+// handleSignal opens a signal once and hands it to every OnSignal callback
+func (s *ServerConn) handleSignal(raw json.RawMessage) error {
 	s.mutex.Lock()
-	s.started = true
-	s.stopped = false
+	callbacks := append([]*signalCallback(nil), s.signalCallbacks...)
 	s.mutex.Unlock()
-	s.wg.Add(1)
-	defer s.wg.Done()
+	if len(callbacks) == 0 {
+		return ErrUnknownAction
+	}
+	sp, err := decodeSignalPacket(raw)
+	if err != nil {
+		return err
+	}
+	if sealer := s.getSealer(); sealer != nil {
+		if sp, err = sealer.Open(sp); err != nil {
+			return err
+		}
+	}
+	for _, c := range callbacks {
+		c.cb(sp)
+	}
+	return nil
+}
 
-	once := false
-	for {
+// SendSignal sends sp to sp.To. With ServerOptions.Acks it waits until the
+// server acknowledges delivery or reports an error. If ctx has no deadline,
+// the wait is bounded by ServerOptions.AckTimeout.
+//
+// Acks are read by Loop, so SendSignal must not be called from a callback
+// running on the Loop goroutine without spawning a goroutine of its own.
+func (s *ServerConn) SendSignal(ctx context.Context, sp SignalPacket) error {
+	if sp.From == "" {
+		sp.From = s.id
+	}
+	if sealer := s.getSealer(); sealer != nil {
+		var err error
+		if sp, err = sealer.Seal(sp); err != nil {
+			return err
+		}
+	}
+	if !s.acks {
+		b, err := json.Marshal(SignalMessage{Action: ActionSignal, SignalPacket: sp})
+		if err != nil {
+			return err
+		}
+		if err := s.WriteMessage(websocket.TextMessage, b); err != nil {
+			return fmt.Errorf("failed to send '%v' to '%v': %w", sp.Type, sp.To, err)
+		}
+		return nil
+	}
+	_, err := s.request(ctx, func(id string) interface{} {
+		return SignalMessage{
+			Action:       ActionSignal,
+			ID:           id,
+			SignalPacket: sp,
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send '%v' to '%v': %w", sp.Type, sp.To, err)
+	}
+	return nil
+}
+
+type reply struct {
+	raw json.RawMessage
+	err error
+}
+
+// request tags the message built by build with a fresh correlation ID, sends
+// it and waits for the server's reply to it
+func (s *ServerConn) request(ctx context.Context, build func(id string) interface{}) (json.RawMessage, error) {
+	id, err := newCorrelationID()
+	if err != nil {
+		return nil, err
+	}
+	replyChan := make(chan reply, 1)
+	s.mutex.Lock()
+	s.pending[id] = replyChan
+	s.mutex.Unlock()
+	defer func() {
 		s.mutex.Lock()
-		if s.stopped {
-			break
+		delete(s.pending, id)
+		s.mutex.Unlock()
+	}()
+
+	b, err := json.Marshal(build(id))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.WriteMessage(websocket.TextMessage, b); err != nil {
+		return nil, err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ackTimeout)
+		defer cancel()
+	}
+	select {
+	case r := <-replyChan:
+		return r.raw, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no reply from server: %w", ctx.Err())
+	}
+}
+
+// resolve completes the request waiting on id. It returns false if nobody is waiting.
+func (s *ServerConn) resolve(id string, raw json.RawMessage, err error) bool {
+	if id == "" {
+		return false
+	}
+	s.mutex.Lock()
+	replyChan, ok := s.pending[id]
+	s.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case replyChan <- reply{raw, err}:
+	default:
+	}
+	return true
+}
+
+func (s *ServerConn) handleAck(raw json.RawMessage) error {
+	var msg AckMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return err
+	}
+	if !s.resolve(msg.ID, raw, nil) {
+		log.Debugf("Ignoring ack for unknown message '%v'\n", msg.ID)
+	}
+	return nil
+}
+
+func (s *ServerConn) handleServerError(raw json.RawMessage) error {
+	var msg ErrorMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return err
+	}
+	sigErr := &SignalError{To: msg.To, Reason: msg.Error}
+	if s.resolve(msg.ID, raw, sigErr) {
+		return nil
+	}
+	// Not tied to a pending request; surface it through the error callbacks
+	return sigErr
+}
+
+func newCorrelationID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *ServerConn) reportError(err error) {
+	s.mutex.Lock()
+	callbacks := append([]*errorCallback(nil), s.errorCallbacks...)
+	s.mutex.Unlock()
+	if len(callbacks) == 0 {
+		log.Errorf("%v\n", err)
+		return
+	}
+	for _, c := range callbacks {
+		c.cb(err)
+	}
+}
+
+// dispatch routes a raw message to the callbacks registered for its action
+func (s *ServerConn) dispatch(rawMessage []byte) {
+	env, err := decodeEnvelope(rawMessage)
+	if err != nil {
+		s.reportError(&MessageError{Raw: rawMessage, Err: err})
+		return
+	}
+	s.mutex.Lock()
+	callbacks := append([]*actionCallback(nil), s.actionCallbacks[env.Action]...)
+	s.mutex.Unlock()
+	if len(callbacks) == 0 {
+		s.reportError(&MessageError{Action: env.Action, Raw: rawMessage, Err: ErrUnknownAction})
+		return
+	}
+	for _, c := range callbacks {
+		if err := c.cb(rawMessage); err != nil {
+			s.reportError(&MessageError{Action: env.Action, Raw: rawMessage, Err: err})
 		}
+	}
+}
+
+// Loop runs the connection until it is stopped or fails. Prefer Run.
+func (s *ServerConn) Loop() {
+	if err := s.Run(context.Background()); err != nil {
+		log.Warnf("Server connection loop terminated: %v\n", err)
+		return
+	}
+	log.Infof("Server connection loop terminated ...\n")
+}
+
+// Run reads and dispatches messages until ctx is cancelled, Shutdown is
+// called or the connection fails for good. It returns nil after Shutdown,
+// ctx.Err() after cancellation and the read error otherwise.
+func (s *ServerConn) Run(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.started {
 		s.mutex.Unlock()
-		if !once {
-			log.Infof("Starting server connection loop ...\n")
-			once = true
+		return fmt.Errorf("server connection is already running")
+	}
+	s.started = true
+	s.runDone = make(chan struct{})
+	runDone := s.runDone
+	s.mutex.Unlock()
+	defer close(runDone)
+
+	stopHeartbeat := s.startHeartbeat()
+	defer stopHeartbeat()
+
+	// Reads block, so the only way to interrupt one is to close the socket
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.closeGracefully(time.Now().Add(time.Second))
+		case <-runDone:
 		}
+	}()
+
+	log.Infof("Starting server connection loop ...\n")
+	for {
 		_, rawMessage, err := s.ReadMessage()
 		if err != nil {
-			if websocket.IsCloseError(err) {
-				log.Debugf("Connection closed")
-				break
-			} else {
-				// log.Errorf("Failed to read message from server connection: %v\n", err)
+			s.setState(StateDisconnected)
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
-			continue
-		}
-		var msg map[string]interface{}
-		if err = json.Unmarshal(rawMessage, &msg); err != nil {
-			log.Errorf("Failed to parse JSON from message '%v': %v\n", string(rawMessage), err)
-			continue
-		}
-		action := msg["action"].(string)
-		switch action {
-		case "signal":
-			{
-				sp := SignalPacket{
-					From: msg["from"].(string),
-					To:   msg["to"].(string),
-					Type: msg["type"].(string),
-					Data: msg["data"].(string),
-				}
-				for _, cb := range s.signalCallbacks {
-					cb(sp)
-				}
+			s.mutex.Lock()
+			stopped := s.stopped
+			s.mutex.Unlock()
+			if stopped {
+				return nil
 			}
+			// Reconnecting connections only fail reads once they are closed
+			return fmt.Errorf("connection closed: %w", err)
 		}
+		s.dispatch(rawMessage)
 	}
-	log.Warnf("Server connection loop terminated ...\n")
 }
 
-func (s *ServerConn) Stop() {
+// Shutdown says goodbye to the server, closes the connection and waits for
+// Run to return or ctx to expire
+func (s *ServerConn) Shutdown(ctx context.Context) error {
 	s.mutex.Lock()
-	if !s.started {
-		s.mutex.Unlock()
-		return
-	}
 	s.stopped = true
+	runDone := s.runDone
 	s.mutex.Unlock()
-	s.wg.Wait()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Second)
+	}
+	s.closeGracefully(deadline)
+
+	if runDone == nil {
+		return nil
+	}
+	select {
+	case <-runDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func NewServerConnection(id string, autoReconnect bool) (*ServerConn, error) {
+// closeGracefully sends a close frame on connections that support it and closes the socket
+func (s *ServerConn) closeGracefully(deadline time.Time) {
 	var err error
-	u := url.URL{Scheme: "wss", Host: SERVER_HOST, Path: "/ws"}
-	q := u.Query()
-	q.Set("id", id)
-	u.RawQuery = q.Encode()
-	log.Infof("connecting to %s\n", u.String())
-
-	var conn ServerConnection
-	if autoReconnect {
-		ws := recws.RecConn{
-			KeepAliveTimeout: 10000 * time.Second,
-			NonVerbose:       true,
-		}
-		ws.Dial(u.String(), nil)
-		conn = &reconnectingConnWrapper{&ws}
-	} else {
-		conn, _, err = websocket.DefaultDialer.Dial(u.String(), nil)
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	s.writeMutex.Lock()
+	switch conn := s.ServerConnection.(type) {
+	case *websocket.Conn:
+		err = conn.WriteControl(websocket.CloseMessage, msg, deadline)
+	case *reconnectingConn:
+		err = conn.writeControl(websocket.CloseMessage, msg, deadline)
+	}
+	s.writeMutex.Unlock()
+	if err != nil {
+		log.Debugf("Failed to send close frame: %v\n", err)
+	}
+	s.Close()
+}
+
+// Stop shuts the connection down and waits for Run to return
+func (s *ServerConn) Stop() {
+	s.Shutdown(context.Background())
+}
+
+func newServerConn(id string, conn ServerConnection, opts ServerOptions) *ServerConn {
+	ackTimeout := opts.AckTimeout
+	if ackTimeout == 0 {
+		ackTimeout = defaultAckTimeout
+	}
+	s := &ServerConn{
+		ServerConnection: conn,
+		id:               id,
+		acks:             opts.Acks,
+		ackTimeout:       ackTimeout,
+		actionCallbacks:  make(map[string][]*actionCallback),
+		pending:          make(map[string]chan reply),
+		rooms:            make(map[string]struct{}),
+		state:            StateConnected,
+		heartbeat:        newHeartbeatConfig(opts),
+	}
+	if opts.AutoReconnect {
+		s.state = StateConnecting
+		s.queueSize = opts.QueueSize
+		if s.queueSize <= 0 {
+			s.queueSize = defaultQueueSize
+		}
+	}
+	s.OnAction(ActionSignal, s.handleSignal)
+	s.OnAction(ActionAck, s.handleAck)
+	s.OnAction(ActionError, s.handleServerError)
+	s.OnAction(ActionRoomMembers, s.handleRoomMembers)
+	// Presence is broadcast whether or not we asked to hear about it
+	s.OnAction(ActionPeerJoined, ignorePresence)
+	s.OnAction(ActionPeerLeft, ignorePresence)
+	s.OnAction(ActionPong, s.handlePong)
+	return s
+}
+
+// NewServerConnection connects to the public signaling server as id
+func NewServerConnection(id string, autoReconnect bool) (*ServerConn, error) {
+	opts := DefaultServerOptions()
+	opts.AutoReconnect = autoReconnect
+	return NewServerConnectionWithOptions(id, opts)
+}
+
+// NewServerConnectionWithOptions connects to the signaling server described by opts as id.
+// With AutoReconnect, a failed first attempt is logged and retried in the
+// background; use OnStateChange to learn when the connection is up.
+func NewServerConnectionWithOptions(id string, opts ServerOptions) (*ServerConn, error) {
+	if id == "" {
+		return nil, fmt.Errorf("id must not be empty")
+	}
+	u, err := opts.endpoint(id)
+	if err != nil {
+		return nil, err
+	}
+	dialTimeout := opts.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: dialTimeout,
+		TLSClientConfig:  opts.TLSConfig,
+	}
+	dial := func() (*websocket.Conn, error) {
+		log.Infof("connecting to %s\n", u.String())
+		wsConn, resp, err := dialer.Dial(u.String(), opts.Header)
 		if err != nil {
-			log.Fatal("dial:", err)
+			if resp != nil {
+				return nil, fmt.Errorf("failed to dial %v: %w (status=%v)", u.Host, err, resp.Status)
+			}
+			return nil, fmt.Errorf("failed to dial %v: %w", u.Host, err)
 		}
+		return wsConn, nil
 	}
 
-	return &ServerConn{
-		conn,
-		nil,
-		sync.WaitGroup{},
-		sync.Mutex{},
-		false,
-		false,
-	}, nil
+	if !opts.AutoReconnect {
+		wsConn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		s := newServerConn(id, wsConn, opts)
+		s.everConnected = true
+		return s, nil
+	}
+
+	conn := newReconnectingConn(dial, opts.Backoff)
+	s := newServerConn(id, conn, opts)
+	conn.onState = s.handleConnState
+	if err := conn.start(); err != nil {
+		log.Warnf("Initial connection failed, retrying in background: %v\n", err)
+	}
+	return s, nil
 }
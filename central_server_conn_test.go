@@ -0,0 +1,281 @@
+package dhwani_backend_p2p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerOptionsEndpoint(t *testing.T) {
+	require := require.New(t)
+
+	u, err := ServerOptions{}.endpoint("123")
+	require.Nil(err)
+	require.Equal("wss://"+SERVER_HOST+"/ws?id=123", u.String())
+
+	u, err = ServerOptions{URL: "ws://127.0.0.1:8080", Path: "/signal"}.endpoint("abc")
+	require.Nil(err)
+	require.Equal("ws://127.0.0.1:8080/signal?id=abc", u.String())
+
+	u, err = ServerOptions{URL: "ws://127.0.0.1:8080/custom"}.endpoint("abc")
+	require.Nil(err)
+	require.Equal("/custom", u.Path)
+
+	_, err = ServerOptions{URL: "http://127.0.0.1:8080"}.endpoint("abc")
+	require.NotNil(err)
+}
+
+func TestNewServerConnectionWithOptions(t *testing.T) {
+	require := require.New(t)
+
+	gotID := make(chan string, 1)
+	gotHeader := make(chan string, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotID <- r.URL.Query().Get("id")
+		gotHeader <- r.Header.Get("X-Test")
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"signal","from":"a","to":"b","type":"offer","data":""}`))
+		conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("X-Test", "yes")
+	conn, err := NewServerConnectionWithOptions("b", ServerOptions{
+		URL:         "ws" + strings.TrimPrefix(server.URL, "http"),
+		Header:      header,
+		DialTimeout: time.Second,
+	})
+	require.Nil(err)
+	defer conn.Close()
+	require.Equal("b", <-gotID)
+	require.Equal("yes", <-gotHeader)
+
+	got := make(chan SignalPacket, 1)
+	conn.OnSignal(func(sp SignalPacket) {
+		got <- sp
+	})
+	go conn.Loop()
+	select {
+	case sp := <-got:
+		require.Equal("a", sp.From)
+		require.Equal("offer", sp.Type)
+	case <-time.After(2 * time.Second):
+		require.Fail("timed out waiting for signal")
+	}
+}
+
+func TestNewServerConnectionDialError(t *testing.T) {
+	require := require.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	_, err := NewServerConnectionWithOptions("b", ServerOptions{
+		URL:         "ws" + strings.TrimPrefix(server.URL, "http"),
+		DialTimeout: time.Second,
+	})
+	require.NotNil(err)
+}
+
+func TestDispatch(t *testing.T) {
+	require := require.New(t)
+
+	s := newServerConn("b", nil, ServerOptions{})
+	errs := make([]error, 0)
+	s.OnError(func(err error) {
+		errs = append(errs, err)
+	})
+	signals := make([]SignalPacket, 0)
+	s.OnSignal(func(sp SignalPacket) {
+		signals = append(signals, sp)
+	})
+	presence := 0
+	remove := s.OnAction("presence", func(raw json.RawMessage) error {
+		presence++
+		return nil
+	})
+
+	s.dispatch([]byte(`{"action":"signal","from":"a","to":"b","type":"offer","data":"xyz"}`))
+	require.Equal([]SignalPacket{{From: "a", To: "b", Type: "offer", Data: "xyz"}}, signals)
+	require.Empty(errs)
+
+	s.dispatch([]byte(`{"action":"presence"}`))
+	require.Equal(1, presence)
+
+	// None of these should panic
+	s.dispatch([]byte(`not json`))
+	s.dispatch([]byte(`{"from":"a"}`))
+	s.dispatch([]byte(`{"action":5}`))
+	s.dispatch([]byte(`{"action":"signal","from":5}`))
+	s.dispatch([]byte(`{"action":"signal","to":"b","type":"offer"}`))
+	s.dispatch([]byte(`{"action":"whatever"}`))
+	require.Len(errs, 6)
+	require.Len(signals, 1)
+
+	var msgErr *MessageError
+	require.True(errors.As(errs[5], &msgErr))
+	require.Equal("whatever", msgErr.Action)
+	require.True(errors.Is(errs[5], ErrUnknownAction))
+
+	remove()
+	s.dispatch([]byte(`{"action":"presence"}`))
+	require.Equal(1, presence)
+	require.True(errors.Is(errs[6], ErrUnknownAction))
+
+	// Presence nobody listens for is not an error
+	s.dispatch([]byte(`{"action":"peer-joined","room":"r","peer":"a"}`))
+	s.dispatch([]byte(`{"action":"peer-left","room":"r","peer":"a"}`))
+	require.Len(errs, 7)
+}
+
+type countingSealer struct {
+	opened int
+}
+
+func (c *countingSealer) Seal(sp SignalPacket) (SignalPacket, error) {
+	return sp, nil
+}
+
+func (c *countingSealer) Open(sp SignalPacket) (SignalPacket, error) {
+	c.opened++
+	if sp.Data == "forged" {
+		return sp, errors.New("bad seal")
+	}
+	return sp, nil
+}
+
+func TestSignalOpenedOnce(t *testing.T) {
+	require := require.New(t)
+
+	s := newServerConn("b", nil, ServerOptions{})
+	sealer := &countingSealer{}
+	s.SetSealer(sealer)
+	errs := make([]error, 0)
+	s.OnError(func(err error) {
+		errs = append(errs, err)
+	})
+	received := 0
+	for i := 0; i < 3; i++ {
+		s.OnSignal(func(sp SignalPacket) {
+			received++
+		})
+	}
+
+	s.dispatch([]byte(`{"action":"signal","from":"a","to":"b","type":"offer","data":"xyz"}`))
+	require.Equal(1, sealer.opened)
+	require.Equal(3, received)
+
+	s.dispatch([]byte(`{"action":"signal","from":"a","to":"b","type":"offer","data":"forged"}`))
+	require.Equal(2, sealer.opened)
+	require.Equal(3, received)
+	require.Len(errs, 1)
+}
+
+func TestSendSignalTimeout(t *testing.T) {
+	require := require.New(t)
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Swallow everything without acknowledging it
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	conn, err := NewServerConnectionWithOptions("b", ServerOptions{
+		URL:         "ws" + strings.TrimPrefix(server.URL, "http"),
+		DialTimeout: time.Second,
+		Acks:        true,
+		AckTimeout:  100 * time.Millisecond,
+	})
+	require.Nil(err)
+	defer conn.Close()
+	go conn.Loop()
+
+	err = conn.SendSignal(context.Background(), SignalPacket{To: "a", Type: "offer"})
+	require.True(errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestRunAndShutdown(t *testing.T) {
+	require := require.New(t)
+
+	closeCodes := make(chan int, 2)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				if closeErr, ok := err.(*websocket.CloseError); ok {
+					closeCodes <- closeErr.Code
+				}
+				return
+			}
+		}
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for _, autoReconnect := range []bool{false, true} {
+		// Cancelling the context stops Run
+		conn, err := NewServerConnectionWithOptions("b", ServerOptions{URL: url, AutoReconnect: autoReconnect})
+		require.Nil(err)
+		ctx, cancel := context.WithCancel(context.Background())
+		result := make(chan error, 1)
+		go func() {
+			result <- conn.Run(ctx)
+		}()
+		cancel()
+		select {
+		case err := <-result:
+			require.True(errors.Is(err, context.Canceled))
+		case <-time.After(2 * time.Second):
+			require.Fail("Run did not return after cancel")
+		}
+		require.Equal(websocket.CloseNormalClosure, <-closeCodes)
+
+		// Shutdown stops Run cleanly and says goodbye to the server
+		conn, err = NewServerConnectionWithOptions("b", ServerOptions{URL: url, AutoReconnect: autoReconnect})
+		require.Nil(err)
+		go func() {
+			result <- conn.Run(context.Background())
+		}()
+		require.Eventually(func() bool {
+			conn.mutex.Lock()
+			defer conn.mutex.Unlock()
+			return conn.started
+		}, time.Second, 5*time.Millisecond)
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 2*time.Second)
+		require.Nil(conn.Shutdown(shutdownCtx))
+		shutdownCancel()
+		require.Nil(<-result)
+		require.Equal(websocket.CloseNormalClosure, <-closeCodes)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/alecthomas/kingpin"
+	"github.com/gurupras/dhwani_backend_p2p/admission"
+)
+
+var (
+	allowPeers      = kingpin.Flag("allow", "Let a peer listen without a PIN or approval. May be repeated. Without --allow, --pin or --approve everyone may listen").Strings()
+	listenPIN       = kingpin.Flag("pin", "PIN that peers not on the allowlist must put in their offer").Envar("DHWANI_PIN").String()
+	approve         = kingpin.Flag("approve", "Hold peers not on the allowlist until an operator approves them on the control websocket").Bool()
+	approvalTimeout = kingpin.Flag("approval-timeout", "Reject peers nobody approved in this long. 0 waits forever").Default("2m").Duration()
+	maxListeners    = kingpin.Flag("max-listeners", "Most peers connected at once. 0 means no limit").Int()
+)
+
+var admissionPolicy *admission.Policy
+
+// newAdmissionPolicy returns the admission policy configured on the command
+// line. Requests awaiting approval are announced on the control websockets.
+func newAdmissionPolicy() *admission.Policy {
+	policy := admission.NewPolicy(admission.Options{
+		Allow:           *allowPeers,
+		PIN:             *listenPIN,
+		Approve:         *approve,
+		ApprovalTimeout: *approvalTimeout,
+	})
+	policy.OnPending(func(req admission.Pending) {
+		broadcast(map[string]interface{}{
+			"action": "admission-request",
+			"data":   req,
+		})
+	})
+	return policy
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/gurupras/dhwani_backend_p2p/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	bitrateFloor   = kingpin.Flag("bitrate-floor", "Lowest bitrate in bps to send any peer at").Default("16000").Int()
+	bitrateCeiling = kingpin.Flag("bitrate-ceiling", "Highest bitrate in bps to send any peer at. 0 disables adapting to congestion").Default("128000").Int()
+	bitrateStart   = kingpin.Flag("bitrate-start", "Bitrate in bps to assume for a new peer").Default("64000").Int()
+	bitrateTiers   = kingpin.Flag("bitrate-tiers", "Bitrate in bps of one encoding of every source. Peers receive the best one their bitrate allows. May be repeated").Default("24000", "64000", "128000").Ints()
+)
+
+// bitrateConfig returns the bitrate limits configured on the command line
+func bitrateConfig() (peer.BitrateConfig, error) {
+	config := peer.BitrateConfig{
+		Floor:   *bitrateFloor,
+		Ceiling: *bitrateCeiling,
+		Initial: *bitrateStart,
+	}
+	if config.Ceiling > 0 && config.Floor > config.Ceiling {
+		return config, fmt.Errorf("bitrate floor %v is above the ceiling %v", config.Floor, config.Ceiling)
+	}
+	return config, nil
+}
+
+// tiers returns the configured encodings in ascending order
+func tiers() []int {
+	if *bitrateCeiling == 0 {
+		return nil
+	}
+	result := append([]int(nil), *bitrateTiers...)
+	sort.Ints(result)
+	return result
+}
+
+// onBitrate moves remoteID to the encodings that fit its estimated bitrate
+func onBitrate(remoteID string, bps int) {
+	log.Debugf("Estimated bitrate of '%v' is %vbps\n", remoteID, bps)
+	for _, swap := range audioSources.SetBitrate(remoteID, bps) {
+		if err := peers.ReplaceSessionTrack(remoteID, swap.Old, swap.New); err != nil {
+			log.Errorf("Failed to change the encoding sent to '%v': %v\n", remoteID, err)
+		}
+	}
+}
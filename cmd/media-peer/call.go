@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/gurupras/dhwani_backend_p2p/peer"
+)
+
+var (
+	callPeers      = kingpin.Flag("call", "Call this peer on startup and redial it whenever the connection is lost. May be repeated").Strings()
+	callPIN        = kingpin.Flag("call-pin", "PIN to send the peers we call").Envar("DHWANI_CALL_PIN").String()
+	redialMin      = kingpin.Flag("redial-min", "Wait before the first redial").Default("1s").Duration()
+	redialMax      = kingpin.Flag("redial-max", "Longest wait between redials").Default("1m").Duration()
+	connectTimeout = kingpin.Flag("connect-timeout", "Give up on a call that has not connected in this long").Default("30s").Duration()
+)
+
+// startCalls calls every peer given with --call until ctx is done
+func startCalls(ctx context.Context) {
+	options := peer.CallOptions{
+		PIN:            *callPIN,
+		MinBackoff:     *redialMin,
+		MaxBackoff:     *redialMax,
+		ConnectTimeout: *connectTimeout,
+	}
+	for _, remoteID := range *callPeers {
+		go peers.Call(ctx, remoteID, options)
+	}
+}
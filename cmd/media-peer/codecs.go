@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/alecthomas/kingpin"
+	rtpaudio "github.com/gurupras/dhwani_backend_p2p/rtp/audio"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	extraCodecs = kingpin.Flag("codec", "Also encode recorded sources as this codec for peers that prefer it: pcmu, pcma, g722 or l16. May be repeated").Strings()
+	channels    = kingpin.Flag("channels", "Channels to record new sources with. Sources with more than 2 are also sent as stereo to peers without multiopus").Default("2").Int()
+	multiopus   = kingpin.Flag("multiopus", "Offer multiopus for 3 to 8 channels so surround sources reach peers that support it").Bool()
+)
+
+// surroundPayloadTypes are dynamic payload types pion does not use by default,
+// one for every channel count multiopus lays out
+var surroundPayloadTypes = map[int]webrtc.PayloadType{3: 103, 4: 104, 5: 105, 6: 112, 7: 106, 8: 113}
+
+// codecs returns the codecs sources are encoded as besides Opus
+func codecs() ([]rtpaudio.Codec, error) {
+	result := make([]rtpaudio.Codec, 0, len(*extraCodecs))
+	for _, name := range *extraCodecs {
+		codec, err := rtpaudio.LookupCodec(name)
+		if err != nil {
+			return nil, err
+		}
+		if codec.Name == rtpaudio.Opus.Name {
+			return nil, fmt.Errorf("sources are always encoded as Opus")
+		}
+		result = append(result, codec)
+	}
+	return result, nil
+}
+
+// surroundCodecs returns the multiopus codecs to register besides the defaults
+func surroundCodecs() ([]webrtc.RTPCodecParameters, error) {
+	if *channels < 1 {
+		return nil, fmt.Errorf("sources need at least 1 channel")
+	}
+	if _, err := rtpaudio.OpusCodec(*channels); err != nil {
+		return nil, err
+	}
+	if !*multiopus {
+		return nil, nil
+	}
+	result := make([]webrtc.RTPCodecParameters, 0, len(surroundPayloadTypes))
+	for count := 3; count <= 8; count++ {
+		codec, err := rtpaudio.OpusCodec(count)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, webrtc.RTPCodecParameters{RTPCodecCapability: codec.Capability, PayloadType: surroundPayloadTypes[count]})
+	}
+	return result, nil
+}
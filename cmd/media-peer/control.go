@@ -0,0 +1,130 @@
+package main
+
+import (
+	"github.com/gurupras/dhwani_backend_p2p/alsa"
+	log "github.com/sirupsen/logrus"
+)
+
+// handleControl runs a control command from the local websocket or a remote
+// peer's control channel. It returns nil for unknown actions.
+func handleControl(msg map[string]interface{}) map[string]interface{} {
+	action, _ := msg["action"].(string)
+	log.Debugf("action=%v\n", action)
+
+	response := make(map[string]interface{})
+	switch action {
+	case "get-devices":
+		devices, err := alsa.ListDevicesWithLib()
+		response["action"] = "get-devices-response"
+		response["data"] = devices
+		if err != nil {
+			response["error"] = err.Error()
+		}
+	case "start-rtp-server":
+		response["action"] = "started-rtp-server"
+		port := 3131
+		if rawPort, ok := msg["data"]; ok {
+			value, ok := rawPort.(float64)
+			if !ok {
+				response["error"] = "The 'data' field must be a port number"
+				return response
+			}
+			port = int(value)
+		}
+		name := sourceName(msg)
+		log.Debugf("source: %v port: %v\n", name, port)
+		response["data"] = ID
+		if _, err := audioSources.StartRTP(name, port); err != nil {
+			response["error"] = err.Error()
+			return response
+		}
+		log.Debugf("Started RTP server on port=%v\n", port)
+	case "start-audio-stream":
+		response["action"] = "started-audio-stream"
+		identifier, ok := msg["data"].(string)
+		if !ok {
+			response["error"] = "Must specify a device identifier in the 'data' field"
+			return response
+		}
+		if err := audioSources.StartRecorder(sourceName(msg), identifier); err != nil {
+			log.Errorf("Failed to start audio process: %v\n", err)
+			response["error"] = err.Error()
+		}
+	case "list-sources":
+		response["action"] = "sources"
+		response["data"] = audioSources.Sources()
+	case "add-source":
+		response["action"] = "added-source"
+		data, _ := msg["data"].(map[string]interface{})
+		name, _ := data["name"].(string)
+		device, _ := data["device"].(string)
+		// 0 means the --channels default
+		channels, _ := data["channels"].(float64)
+		info, err := audioSources.Add(name, device, int(channels))
+		if err != nil {
+			response["error"] = err.Error()
+		} else {
+			response["data"] = info
+		}
+	case "set-channels":
+		response["action"] = "channels-set"
+		channels, ok := msg["data"].(float64)
+		if !ok {
+			response["error"] = "Must specify the number of channels in the 'data' field"
+			return response
+		}
+		info, err := audioSources.SetChannels(sourceName(msg), int(channels))
+		if err != nil {
+			response["error"] = err.Error()
+		} else {
+			response["data"] = info
+		}
+	case "remove-source":
+		response["action"] = "removed-source"
+		name, _ := msg["data"].(string)
+		if err := audioSources.Remove(name); err != nil {
+			response["error"] = err.Error()
+		}
+	case "get-stats":
+		response["action"] = "stats"
+		response["data"] = peers.Stats()
+	case "set-volume":
+		response["action"] = "volume-set"
+		data, _ := msg["data"].(map[string]interface{})
+		peerID, _ := data["peer"].(string)
+		volume, ok := data["volume"].(float64)
+		if peerID == "" || !ok || volume < 0 {
+			response["error"] = "Must specify 'peer' and a non-negative 'volume' in the 'data' field"
+			return response
+		}
+		setVolume(peerID, volume)
+	case "list-pending":
+		response["action"] = "pending"
+		response["data"] = admissionPolicy.Pending()
+	case "approve":
+		response["action"] = "approved"
+		peerID, _ := msg["data"].(string)
+		response["data"] = peerID
+		if err := admissionPolicy.Approve(peerID); err != nil {
+			response["error"] = err.Error()
+		}
+	case "reject":
+		response["action"] = "rejected"
+		peerID, _ := msg["data"].(string)
+		response["data"] = peerID
+		if err := admissionPolicy.Reject(peerID); err != nil {
+			response["error"] = err.Error()
+		}
+	default:
+		return nil
+	}
+	return response
+}
+
+// sourceName returns the source a control message refers to
+func sourceName(msg map[string]interface{}) string {
+	if name, ok := msg["source"].(string); ok && name != "" {
+		return name
+	}
+	return defaultSource
+}
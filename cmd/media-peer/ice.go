@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/alecthomas/kingpin"
+	"github.com/gurupras/dhwani_backend_p2p/peer"
+)
+
+var (
+	iceServersFile = kingpin.Flag("ice-servers", "JSON file listing ICE servers. Overrides the --stun and --turn flags").String()
+	stunURLs       = kingpin.Flag("stun", "STUN server URL. May be repeated").Default("stun:ice-us-east-269qnzqlg2.twoseven.xyz:4558").Strings()
+	turnURLs       = kingpin.Flag("turn", "TURN server URL. May be repeated").Strings()
+	turnUsername   = kingpin.Flag("turn-username", "Static TURN username, or the user part of generated usernames when --turn-secret is set").String()
+	turnCredential = kingpin.Flag("turn-credential", "Static TURN credential").String()
+	turnSecret     = kingpin.Flag("turn-secret", "Secret shared with the TURN server for generating time-limited credentials").Envar("DHWANI_TURN_SECRET").String()
+	turnTTL        = kingpin.Flag("turn-ttl", "Lifetime of generated TURN credentials").Default(peer.DefaultTURNTTL.String()).Duration()
+)
+
+// iceServers returns the ICE servers configured on the command line
+func iceServers() ([]peer.ICEServer, error) {
+	if *iceServersFile != "" {
+		return peer.LoadICEServers(*iceServersFile)
+	}
+	servers := make([]peer.ICEServer, 0, 2)
+	if len(*stunURLs) > 0 {
+		servers = append(servers, peer.ICEServer{URLs: *stunURLs})
+	}
+	if len(*turnURLs) > 0 {
+		servers = append(servers, peer.ICEServer{
+			URLs:       *turnURLs,
+			Username:   *turnUsername,
+			Credential: *turnCredential,
+			Secret:     *turnSecret,
+			TTL:        peer.Duration(*turnTTL),
+		})
+	}
+	return servers, nil
+}
@@ -1,29 +1,78 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"context"
 	"encoding/json"
-	"fmt"
-	"io"
+	"net"
 	"net/http"
-	"os/exec"
-	"strings"
-
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/alecthomas/kingpin"
 	"github.com/gorilla/websocket"
 	p2p "github.com/gurupras/dhwani_backend_p2p"
-	"github.com/gurupras/dhwani_backend_p2p/alsa"
-	"github.com/gurupras/dhwani_backend_p2p/record"
-	"github.com/gurupras/dhwani_backend_p2p/rtp/audio"
+	"github.com/gurupras/dhwani_backend_p2p/control"
+	"github.com/gurupras/dhwani_backend_p2p/e2e"
+	"github.com/gurupras/dhwani_backend_p2p/identity"
+	"github.com/gurupras/dhwani_backend_p2p/peer"
+	"github.com/gurupras/dhwani_backend_p2p/sources"
+	"github.com/gurupras/dhwani_backend_p2p/whip"
 	"github.com/pion/webrtc/v3"
 	log "github.com/sirupsen/logrus"
 )
 
+var (
+	identityDir = kingpin.Flag("identity-dir", "Directory holding this peer's identity and pinned peers").Default(defaultIdentityDir()).String()
+	pairWith    = kingpin.Flag("pair", "Pin the identity of a peer, given as ID=PAIRING-CODE. May be repeated").StringMap()
+	operators   = kingpin.Flag("operator", "Allow a peer to run every control command over its data channel. May be repeated").Strings()
+	permissions = kingpin.Flag("permissions", "JSON file mapping peer IDs to the control commands they may run").String()
+	statsEvery  = kingpin.Flag("stats-interval", "How often to log connection statistics of every peer. 0 disables").Default("30s").Duration()
+)
+
 var upgrader = websocket.Upgrader{}
 
-var audioRTP *audio.AudioRTP
+// controlSocket is a connection to the control websocket. Responses and
+// broadcasts may be written to it concurrently
+type controlSocket struct {
+	conn  *websocket.Conn
+	mutex sync.Mutex
+}
+
+func (s *controlSocket) send(msg map[string]interface{}) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conn.WriteMessage(websocket.TextMessage, b)
+}
+
+var socketsMutex sync.Mutex
+var sockets = make(map[*controlSocket]bool)
+
+// broadcast sends msg to every connected control websocket
+func broadcast(msg map[string]interface{}) {
+	socketsMutex.Lock()
+	defer socketsMutex.Unlock()
+	for socket := range sockets {
+		if err := socket.send(msg); err != nil {
+			log.Errorf("Failed to send '%v': %v\n", msg["action"], err)
+		}
+	}
+}
+
+// defaultSource is used by control messages that do not name a source
+const defaultSource = "default"
+
+var audioSources = sources.NewManager()
 var ID string
 var serverConn *p2p.ServerConn
+var peers *peer.PeerManager
 
 func rootHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Hello World"))
@@ -33,13 +82,22 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
+		return
 	}
 	reader(ws)
 }
 
 func reader(conn *websocket.Conn) {
 	log.Infof("Starting reader\n")
-	var audioProcess *exec.Cmd
+	socket := &controlSocket{conn: conn}
+	socketsMutex.Lock()
+	sockets[socket] = true
+	socketsMutex.Unlock()
+	defer func() {
+		socketsMutex.Lock()
+		delete(sockets, socket)
+		socketsMutex.Unlock()
+	}()
 	for {
 		// read in a message
 		messageType, p, err := conn.ReadMessage()
@@ -56,257 +114,217 @@ func reader(conn *websocket.Conn) {
 			continue
 		}
 
-		response := make(map[string]interface{})
-		sendResponse := func() {
-			log.Debugf("Sending back '%v'\n", response["action"])
-			b, _ := json.Marshal(response)
-			if err = conn.WriteMessage(websocket.TextMessage, b); err != nil {
-				log.Errorf("Failed to send '%v': %v\n", response["action"], err)
-				return
-			}
+		response := handleControl(msg)
+		if response == nil {
+			continue
 		}
-
-		action := msg["action"].(string)
-		log.Debugf("action=%v\n", action)
-		switch action {
-		case "get-devices":
-			{
-				devices, err := alsa.ListDevicesWithLib()
-				response["action"] = "get-devices-response"
-				response["data"] = devices
-				if err != nil {
-					response["error"] = err.Error()
-				}
-				sendResponse()
-			}
-		case "start-rtp-server":
-			{
-				rawPort, ok := msg["data"]
-				var port int
-				if !ok {
-					port = 3131
-				} else {
-					port = int(rawPort.(float64))
-				}
-				log.Debugf("port: %v\n", port)
-				if audioRTP != nil {
-					audioRTP.Stop()
-				}
-				audioRTP = audio.SetupExternalRTP(port)
-				go audioRTP.Loop()
-
-				response["action"] = "started-rtp-server"
-				response["data"] = ID
-				sendResponse()
-				log.Debugf("Started RTP server on port=%v\n", port)
-			}
-		case "start-audio-stream":
-			{
-				response["action"] = "started-audio-stream"
-
-				identifier, ok := msg["data"].(string)
-				if !ok {
-					response["error"] = "Must specify a device identifier in the 'data' field"
-					sendResponse()
-					return
-				}
-				if audioProcess != nil {
-					audioProcess.Process.Kill()
-				}
-				audioProcess := record.NewRecorder(identifier, audioRTP.Port)
-				if err = audioProcess.Start(); err != nil {
-					log.Errorf("Failed to start audio process: %v\n", err)
-
-				}
-				sendResponse()
-			}
+		log.Debugf("Sending back '%v'\n", response["action"])
+		if err = socket.send(response); err != nil {
+			log.Errorf("Failed to send '%v': %v\n", response["action"], err)
 		}
 	}
 }
 
-func encodeToString(max int) string {
-	b := make([]byte, max)
-	n, err := io.ReadAtLeast(rand.Reader, b, max)
-	if n != max {
-		panic(err)
-	}
-	for i := 0; i < len(b); i++ {
-		b[i] = table[int(b[i])%len(table)]
+// syncTracks gives every session the tracks of the sources it should receive
+func syncTracks() {
+	for _, session := range peers.Sessions() {
+		if err := peers.SetTracks(session.RemoteID, audioSources.Tracks(session.RemoteID)); err != nil {
+			log.Errorf("Failed to update tracks of '%v': %v\n", session.RemoteID, err)
+		}
 	}
-	return string(b)
 }
 
-var table = [...]byte{'1', '2', '3', '4', '5', '6', '7', '8', '9', '0'}
+// sessionClosed forgets what we knew about a peer once its session has closed
+func sessionClosed(remoteID string) {
+	audioSources.Forget(remoteID)
+	endIngest(remoteID)
+}
+
+func defaultIdentityDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".dhwani"
+	}
+	return filepath.Join(dir, "dhwani")
+}
 
 func main() {
+	kingpin.Parse()
 	log.SetLevel(log.DebugLevel)
 	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
 	var err error
 
-	// This peer is going to let the server know that it has a unique ID that is 9 digits long
-	// ID = encodeToString(9)
-	ID = "111111111"
-	log.Infof("ID=%v\n", ID)
-
-	serverConn, err = p2p.NewServerConnection(ID, true)
+	// Our ID is derived from a keypair created on first run, so it is stable.
+	// Peers trust us once they pin that key, not because of the ID
+	self, err := identity.LoadOrCreate(*identityDir)
 	if err != nil {
-		log.Fatalf("Failed to set up server connection")
+		log.Fatalf("Failed to load identity from '%v': %v\n", *identityDir, err)
 	}
-	go serverConn.Loop()
+	ID = self.ID
+	log.Infof("ID=%v pairing-code=%v\n", ID, self.PairingCode())
 
-	pcMap := make(map[string]*webrtc.PeerConnection)
+	keyring, err := identity.OpenKeyring(*identityDir)
+	if err != nil {
+		log.Fatalf("Failed to load pinned peers: %v\n", err)
+	}
 
-	serverConn.OnSignal(func(sp p2p.SignalPacket) {
-		from := sp.From
-		dataBytes, err := base64.StdEncoding.DecodeString(sp.Data)
-		if err != nil {
-			log.Errorf("Bad offer. Expected base64 encoded data: %v\n", err)
-			return
+	serverConn, err = p2p.NewServerConnection(ID, true)
+	if err != nil {
+		log.Fatalf("Failed to set up server connection: %v\n", err)
+	}
+	serverConn.OnStateChange(func(state p2p.ConnState) {
+		log.Infof("Server connection %v\n", state)
+	})
+	// Peers we paired with must seal their signals; everyone else (e.g. browsers) may not.
+	// Peers that paired with us but not we with them get sealed replies
+	serverConn.SetSealer(e2e.NewSealer(self.Keys, keyring, e2e.Options{Optional: true}))
+	identity.ServeIdentity(serverConn, self)
+
+	grants := control.NewPermissions()
+	if *permissions != "" {
+		if grants, err = control.LoadPermissions(*permissions); err != nil {
+			log.Fatalf("Failed to load permissions: %v\n", err)
 		}
-		switch sp.Type {
-		case "offer":
-			{
-				offer := webrtc.SessionDescription{}
-				if err = json.Unmarshal(dataBytes, &offer); err != nil {
-					log.Errorf("Bad offer. Failed to unmarshal JSON: %v\n", err)
-					return
-				}
-				peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{
-					ICEServers: []webrtc.ICEServer{
-						{
-							URLs: []string{"stun:ice-us-east-269qnzqlg2.twoseven.xyz:4558"},
-						},
-						{
-							URLs: []string{
-								"turn:ice-us-east-269qnzqlg2.twoseven.xyz:4558?transport=udp",
-								"turn:ice-us-east-269qnzqlg2.twoseven.xyz:4558?transport=tcp",
-							},
-							Username:       "1642471464:twoseven",
-							Credential:     "PaQln41l2CoGu+W++dk7rH0eIrI=",
-							CredentialType: webrtc.ICECredentialTypePassword,
-						},
-					},
-				})
-				if err != nil {
-					panic(err)
-				}
-				pcMap[from] = peerConnection
-				rtpSender, err := peerConnection.AddTrack(audioRTP.Track)
-				if err != nil {
-					panic(err)
-				}
-
-				// Read incoming RTCP packets
-				// Before these packets are returned they are processed by interceptors. For things
-				// like NACK this needs to be called.
-				go func() {
-					rtcpBuf := make([]byte, 1500)
-					for {
-						if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
-							return
-						}
-					}
-				}()
-
-				// Set the handler for ICE connection state
-				// This will notify you when the peer has connected/disconnected
-				peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-					fmt.Printf("Connection State has changed %s \n", connectionState.String())
-
-					if connectionState == webrtc.ICEConnectionStateFailed {
-						if closeErr := peerConnection.Close(); closeErr != nil {
-							panic(closeErr)
-						}
-					}
-				})
-
-				peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
-					if i == nil {
-						return
-					}
-					candidateData := make(map[string]interface{})
-					candidateData["type"] = "candidate"
-					candidateData["candidate"] = i.ToJSON()
-					b, _ := json.Marshal(candidateData)
-					answerData := make(map[string]interface{})
-					answerData["action"] = "signal"
-					answerData["from"] = ID
-					answerData["to"] = sp.From
-					answerData["data"] = base64.StdEncoding.EncodeToString(b)
-
-					b, _ = json.Marshal(answerData)
-					if err = serverConn.WriteMessage(websocket.TextMessage, b); err != nil {
-						log.Errorf("Failed to send ice-candidate: %v\n", err)
-						return
-					} else {
-						// log.Debugf("Sent ICE candidate. to=%v\n", from)
-					}
-				})
-
-				// Set the remote SessionDescription
-				if err = peerConnection.SetRemoteDescription(offer); err != nil {
-					panic(err)
-				}
-
-				// Create answer
-				answer, err := peerConnection.CreateAnswer(nil)
-				if err != nil {
-					panic(err)
-				}
-
-				// Create channel that is blocked until ICE Gathering is complete
-				gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	}
+	for _, operator := range *operators {
+		grants.Grant(operator, control.AllActions)
+	}
+	controlServer := control.NewServer(grants, handleControl)
 
-				// Sets the LocalDescription, and starts our UDP listeners
-				if err = peerConnection.SetLocalDescription(answer); err != nil {
-					panic(err)
-				}
+	if *playback {
+		if err := startPlayback(); err != nil {
+			log.Fatalf("Failed to start playback: %v\n", err)
+		}
+	}
 
-				// Block until ICE Gathering is complete, disabling trickle ICE
-				// we do this because we only can exchange one signaling message
-				// in a production application you should exchange ICE Candidates via OnICECandidate
-				<-gatherComplete
-				log.Debugf("ICE gathering complete\n")
+	servers, err := iceServers()
+	if err != nil {
+		log.Fatalf("Failed to configure ICE servers: %v\n", err)
+	}
+	bitrate, err := bitrateConfig()
+	if err != nil {
+		log.Fatalf("Invalid bitrate limits: %v\n", err)
+	}
+	surround, err := surroundCodecs()
+	if err != nil {
+		log.Fatalf("Invalid channels: %v\n", err)
+	}
+	api, err := peer.NewAPI(surround...)
+	if err != nil {
+		log.Fatalf("Failed to set up WebRTC: %v\n", err)
+	}
+	audioSources.Tiers = tiers()
+	audioSources.Channels = *channels
+	if audioSources.Codecs, err = codecs(); err != nil {
+		log.Fatalf("Invalid codec: %v\n", err)
+	}
+	admissionPolicy = newAdmissionPolicy()
+	peers = peer.NewPeerManager(serverConn, peer.Config{
+		API:            api,
+		ICEServers:     servers,
+		Tracks:         audioSources.Tracks,
+		OnRemoteCodecs: audioSources.SetCodecs,
+		OnDataChannel:  controlServer.ServeDataChannel,
+		OnTrack:        onTrack,
+		OnClose:        sessionClosed,
+		Bitrate:        bitrate,
+		OnBitrate:      onBitrate,
+		Admit:          admissionPolicy.Admit,
+		MaxSessions:    *maxListeners,
+	})
 
-				answerData := make(map[string]interface{})
-				answerData["action"] = "signal"
-				answerData["from"] = ID
-				answerData["to"] = sp.From
-				answer.SDP = strings.Replace(answer.SDP, "useinbandfec=1", "useinbandfec=1; maxaveragebitrate=2560000", 1)
-				b, _ := json.Marshal(answer)
-				answerData["data"] = base64.StdEncoding.EncodeToString(b)
-				b, _ = json.Marshal(answerData)
-				if err = serverConn.WriteMessage(websocket.TextMessage, b); err != nil {
-					log.Errorf("Failed to send answer: %v\n", err)
-					return
-				}
-				// log.Debugf("Sent back answer to peer=%v answer=%v\n", sp.From, answer.SDP)
-			}
-		case "candidate":
-			{
-				var obj map[string]interface{}
-				candidateBytes, err := json.Marshal(obj["candidate"])
-				if err != nil {
-					log.Errorf("Failed to marshal 'candidate' key: %v\n", err)
-					return
-				}
-				candidate := webrtc.ICECandidateInit{}
-				if err = json.Unmarshal(candidateBytes, &candidate); err != nil {
-					log.Errorf("Bad candidate. Failed to unmarshal JSON: %v\n", err)
-					return
-				}
-				peerConnection, ok := pcMap[from]
-				if !ok {
-					log.Errorf("Unknown peer '%v'. Ignored candidate\n", from)
-					return
-				}
-				peerConnection.AddICECandidate(candidate)
+	audioSources.OnTrackChange(func(name string, old, track webrtc.TrackLocal) {
+		if old != nil && track != nil {
+			// Connected peers switch to the new track without renegotiating
+			if err := peers.ReplaceTrack(old, track); err != nil {
+				log.Errorf("Failed to replace track of source '%v': %v\n", name, err)
 			}
+			return
+		}
+		syncTracks()
+	})
+	hasSession := func(remoteID string) bool {
+		_, ok := peers.Session(remoteID)
+		return ok
+	}
+	sources.Serve(serverConn, audioSources, hasSession, func(remoteID string) {
+		if !hasSession(remoteID) {
+			return
+		}
+		if err := peers.SetTracks(remoteID, audioSources.Tracks(remoteID)); err != nil {
+			log.Errorf("Failed to update tracks of '%v': %v\n", remoteID, err)
 		}
 	})
+	serverConn.OnSignal(func(sp p2p.SignalPacket) {
+		if err := peers.HandleSignal(sp); err != nil {
+			log.Errorf("%v\n", err)
+		}
+	})
+	// Every signal handler is registered before we start reading signals, so
+	// none that arrive while we start up are lost
+	go serverConn.Loop()
+
+	for peerID, code := range *pairWith {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := identity.Pair(ctx, serverConn, keyring, peerID, code); err != nil {
+			log.Errorf("Failed to pair with '%v': %v\n", peerID, err)
+		} else {
+			log.Infof("Paired with '%v'\n", peerID)
+		}
+		cancel()
+	}
+	for _, operator := range *operators {
+		if _, ok := keyring.Lookup(operator); !ok {
+			log.Warnf("Operator '%v' is not paired. Anyone the signaling server lets use that ID can control this peer\n", operator)
+		}
+	}
+	calls, stopCalls := context.WithCancel(context.Background())
+	startCalls(calls)
+	if *statsEvery > 0 {
+		go func() {
+			for range time.Tick(*statsEvery) {
+				peers.LogStats()
+			}
+		}()
+	}
+
 	http.HandleFunc("/", rootHandler)
 	http.HandleFunc("/ws", wsHandler)
+	whip.NewServer(peers, whipOptions()).Handle(http.DefaultServeMux)
+	requests, cancelRequests := context.WithCancel(context.Background())
+	server := &http.Server{
+		Addr: ":4234",
+		BaseContext: func(net.Listener) context.Context {
+			return requests
+		},
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serverErr:
+		log.Fatal(err)
+	case sig := <-signals:
+		log.Infof("Received %v. Shutting down\n", sig)
+	}
 
-	log.Fatal(http.ListenAndServe(":4234", nil))
-
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		shutdown(ctx, server, cancelRequests, stopCalls)
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Infof("Shut down\n")
+	case <-ctx.Done():
+		log.Fatalf("Shutdown did not finish within %v\n", *shutdownTimeout)
+	case sig := <-signals:
+		log.Fatalf("Received %v during shutdown\n", sig)
+	}
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/kingpin"
+	soundio "github.com/crow-misia/go-libsoundio"
+	"github.com/gurupras/dhwani_backend_p2p/audio"
+	rtpaudio "github.com/gurupras/dhwani_backend_p2p/rtp/audio"
+	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	playback       = kingpin.Flag("playback", "Play audio that peers send us").Bool()
+	playbackDevice = kingpin.Flag("playback-device", "Output device to play peers' audio on. Defaults to the default output device").String()
+	playbackBuffer = kingpin.Flag("playback-buffer", "Most audio queued per peer before the oldest is dropped").Default("200ms").Duration()
+	jitterDepth    = kingpin.Flag("jitter-depth", "Packets held to smooth out network jitter").Default("3").Int()
+)
+
+var player *audio.Player
+
+// playbackInputs holds the inputs playing each peer's tracks, and the volume set for each peer
+var playbackInputs = struct {
+	sync.Mutex
+	inputs  map[string][]*audio.PlayerInput
+	volumes map[string]float64
+}{
+	inputs:  make(map[string][]*audio.PlayerInput),
+	volumes: make(map[string]float64),
+}
+
+func startPlayback() error {
+	var err error
+	var a *audio.Audio
+	for _, backend := range []soundio.Backend{soundio.BackendPulseAudio, soundio.BackendAlsa} {
+		if a, err = audio.NewAudio(backend); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to an audio backend: %w", err)
+	}
+	player, err = a.Play(*playbackDevice, *playbackBuffer)
+	return err
+}
+
+// playTrack plays an Opus track from remoteID until it ends
+func playTrack(remoteID string, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	if player == nil {
+		return
+	}
+	if !strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeOpus) {
+		log.Warnf("Not playing %v track from '%v'\n", track.Codec().MimeType, remoteID)
+		return
+	}
+	input, err := player.Input(remoteID + "/" + track.ID())
+	if err != nil {
+		log.Errorf("Failed to play track from '%v': %v\n", remoteID, err)
+		return
+	}
+	playbackInputs.Lock()
+	playbackInputs.inputs[remoteID] = append(playbackInputs.inputs[remoteID], input)
+	if volume, ok := playbackInputs.volumes[remoteID]; ok {
+		input.SetVolume(volume)
+	}
+	playbackInputs.Unlock()
+	log.Infof("Playing track '%v' from '%v'\n", track.ID(), remoteID)
+
+	defer func() {
+		input.Close()
+		playbackInputs.Lock()
+		defer playbackInputs.Unlock()
+		remaining := playbackInputs.inputs[remoteID][:0]
+		for _, other := range playbackInputs.inputs[remoteID] {
+			if other != input {
+				remaining = append(remaining, other)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(playbackInputs.inputs, remoteID)
+		} else {
+			playbackInputs.inputs[remoteID] = remaining
+		}
+	}()
+
+	jitter := rtpaudio.NewJitterBuffer(*jitterDepth)
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			log.Debugf("Stopped playing track from '%v': %v\n", remoteID, err)
+			return
+		}
+		jitter.Push(packet)
+		for {
+			packet, lost, ok := jitter.Pop()
+			if !ok {
+				break
+			}
+			if lost {
+				err = input.Conceal()
+			} else {
+				err = input.WriteOpus(packet.Payload)
+			}
+			if err != nil {
+				log.Warnf("Failed to decode audio from '%v': %v\n", remoteID, err)
+			}
+		}
+	}
+}
+
+// setVolume scales the audio we play from remoteID
+func setVolume(remoteID string, volume float64) {
+	playbackInputs.Lock()
+	defer playbackInputs.Unlock()
+	playbackInputs.volumes[remoteID] = volume
+	for _, input := range playbackInputs.inputs[remoteID] {
+		input.SetVolume(volume)
+	}
+}
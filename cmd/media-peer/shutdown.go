@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/alecthomas/kingpin"
+	log "github.com/sirupsen/logrus"
+)
+
+var shutdownTimeout = kingpin.Flag("shutdown-timeout", "How long an orderly shutdown may take before we give up and exit").Default("10s").Duration()
+
+// closeSockets disconnects every control websocket. The HTTP server does not
+// track connections it handed over to websockets
+func closeSockets() {
+	socketsMutex.Lock()
+	defer socketsMutex.Unlock()
+	for socket := range sockets {
+		socket.conn.Close()
+	}
+}
+
+// shutdown stops taking requests, says bye to every peer, stops capturing and
+// playing audio and leaves the signaling server, in that order. cancelRequests
+// ends requests still in progress, such as WHEP offers awaiting approval
+func shutdown(ctx context.Context, server *http.Server, cancelRequests func(), stopCalls func()) {
+	cancelRequests()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warnf("Failed to stop the HTTP server: %v\n", err)
+	}
+	closeSockets()
+
+	// Peers we called get their bye before the dialers give up on them.
+	// Dialers redialing meanwhile fail, since no new sessions are created
+	if err := peers.Shutdown(ctx); err != nil {
+		log.Warnf("Failed to say bye to every peer: %v\n", err)
+	}
+	stopCalls()
+
+	audioSources.Close()
+	if player != nil {
+		if err := player.Stop(); err != nil {
+			log.Warnf("Failed to stop playback: %v\n", err)
+		}
+	}
+
+	if err := serverConn.Shutdown(ctx); err != nil {
+		log.Warnf("Failed to leave the signaling server: %v\n", err)
+	}
+}
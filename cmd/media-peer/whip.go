@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/gurupras/dhwani_backend_p2p/whip"
+	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+var whipIngest = kingpin.Flag("whip-ingest", "Let encoders push audio into new sources over WHIP at /whip/<source>. They are admitted like listeners").Bool()
+
+// ingests maps the ID of each WHIP session to the source it pushes into
+var ingests = struct {
+	sync.Mutex
+	sources map[string]string
+}{
+	sources: make(map[string]string),
+}
+
+func whipOptions() whip.Options {
+	if !*whipIngest {
+		return whip.Options{}
+	}
+	return whip.Options{Ingest: startIngest}
+}
+
+// startIngest reserves source for the WHIP encoder remoteID. It is created once audio arrives
+func startIngest(remoteID, source string) error {
+	ingests.Lock()
+	defer ingests.Unlock()
+	for _, other := range ingests.sources {
+		if other == source {
+			return fmt.Errorf("source '%v' is already being pushed", source)
+		}
+	}
+	if _, ok := audioSources.Source(source); ok {
+		return fmt.Errorf("source '%v' already exists", source)
+	}
+	ingests.sources[remoteID] = source
+	return nil
+}
+
+// endIngest removes the source of the WHIP encoder remoteID, if any
+func endIngest(remoteID string) {
+	ingests.Lock()
+	source, ok := ingests.sources[remoteID]
+	delete(ingests.sources, remoteID)
+	ingests.Unlock()
+	if !ok {
+		return
+	}
+	if err := audioSources.Remove(source); err == nil {
+		log.Infof("Source '%v' ended with its encoder\n", source)
+	}
+}
+
+// onTrack forwards tracks of WHIP encoders into their source and plays the rest
+func onTrack(remoteID string, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	ingests.Lock()
+	source, ok := ingests.sources[remoteID]
+	ingests.Unlock()
+	if !ok {
+		playTrack(remoteID, track, receiver)
+		return
+	}
+	if err := forwardTrack(source, track); err != nil {
+		log.Errorf("Failed to push '%v' into source '%v': %v\n", remoteID, source, err)
+	}
+}
+
+// forwardTrack sends the RTP of an Opus track to the RTP server of source
+// until the track ends, just as an encoder on this host would
+func forwardTrack(source string, track *webrtc.TrackRemote) error {
+	if !strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeOpus) {
+		return fmt.Errorf("cannot take %v", track.Codec().MimeType)
+	}
+	info, err := audioSources.StartRTP(source, 0)
+	if err != nil {
+		return err
+	}
+	if info.Channels != 2 {
+		// Encoders send stereo Opus whatever --channels says
+		if info, err = audioSources.SetChannels(source, 2); err != nil {
+			return err
+		}
+	}
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: info.Port})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Infof("Pushing track '%v' into source '%v'\n", track.ID(), source)
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := track.Read(buf)
+		if err != nil {
+			return nil
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/gurupras/dhwani_backend_p2p/signalserver"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	verbose  = kingpin.Flag("verbose", "Debug logs").Short('v').Bool()
+	listen   = kingpin.Flag("listen", "Address to listen on").Short('l').Default(":8080").String()
+	path     = kingpin.Flag("path", "Path of the websocket endpoint").Default("/ws").String()
+	certFile = kingpin.Flag("cert", "TLS certificate file").String()
+	keyFile  = kingpin.Flag("key", "TLS key file").String()
+)
+
+func main() {
+	kingpin.Parse()
+	if *verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	server := signalserver.New()
+	mux := http.NewServeMux()
+	mux.Handle(*path, server)
+
+	log.Infof("Listening on %v%v\n", *listen, *path)
+	if *certFile != "" || *keyFile != "" {
+		log.Fatal(http.ListenAndServeTLS(*listen, *certFile, *keyFile, mux))
+	}
+	log.Fatal(http.ListenAndServe(*listen, mux))
+}
@@ -0,0 +1,149 @@
+// Package control exposes the media-peer control commands to remote peers over
+// a WebRTC data channel, subject to per-peer permissions.
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Label of the data channel remote peers open to send control commands
+const Label = "control"
+
+// AllActions grants every action to a peer
+const AllActions = "*"
+
+// ActionDenied is the action of the reply to a command the peer may not run
+const ActionDenied = "denied"
+
+// Handler runs a control command and returns the response to send back, or nil for none
+type Handler func(msg map[string]interface{}) map[string]interface{}
+
+// Permissions records which control actions each remote peer may run
+type Permissions struct {
+	mutex  sync.Mutex
+	grants map[string]map[string]bool
+}
+
+func NewPermissions() *Permissions {
+	return &Permissions{
+		grants: make(map[string]map[string]bool),
+	}
+}
+
+// LoadPermissions reads a JSON object mapping peer IDs to the actions they may run
+func LoadPermissions(path string) (*Permissions, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string][]string)
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return nil, fmt.Errorf("failed to parse permissions in '%v': %w", path, err)
+	}
+	p := NewPermissions()
+	for peerID, actions := range stored {
+		p.Grant(peerID, actions...)
+	}
+	return p, nil
+}
+
+// Grant allows peerID to run actions. AllActions allows everything
+func (p *Permissions) Grant(peerID string, actions ...string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	granted, ok := p.grants[peerID]
+	if !ok {
+		granted = make(map[string]bool)
+		p.grants[peerID] = granted
+	}
+	for _, action := range actions {
+		granted[action] = true
+	}
+}
+
+// Revoke takes every permission away from peerID
+func (p *Permissions) Revoke(peerID string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.grants, peerID)
+}
+
+// Allowed reports whether peerID may run action
+func (p *Permissions) Allowed(peerID string, action string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	granted := p.grants[peerID]
+	return granted[AllActions] || granted[action]
+}
+
+// Server runs control commands received from remote peers
+type Server struct {
+	permissions *Permissions
+	handler     Handler
+}
+
+func NewServer(permissions *Permissions, handler Handler) *Server {
+	return &Server{
+		permissions: permissions,
+		handler:     handler,
+	}
+}
+
+// ServeDataChannel answers the commands remoteID sends on dc.
+// Channels with a label other than Label are ignored.
+func (s *Server) ServeDataChannel(remoteID string, dc *webrtc.DataChannel) {
+	if dc.Label() != Label {
+		return
+	}
+	log.Infof("Control channel opened by '%v'\n", remoteID)
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		response := s.handle(remoteID, msg.Data)
+		if response == nil {
+			return
+		}
+		if err := dc.SendText(string(response)); err != nil {
+			log.Errorf("Failed to send control response to '%v': %v\n", remoteID, err)
+		}
+	})
+}
+
+// handle runs a single command and returns the encoded response
+func (s *Server) handle(remoteID string, raw []byte) []byte {
+	var msg map[string]interface{}
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		log.Warnf("Received non-JSON control message from '%v'\n", remoteID)
+		return nil
+	}
+	action, _ := msg["action"].(string)
+	var response map[string]interface{}
+	if !s.permissions.Allowed(remoteID, action) {
+		log.Warnf("'%v' is not permitted to run '%v'\n", remoteID, action)
+		response = map[string]interface{}{
+			"action": ActionDenied,
+			"data":   action,
+			"error":  fmt.Sprintf("not permitted to run '%v'", action),
+		}
+	} else {
+		log.Infof("'%v' runs '%v'\n", remoteID, action)
+		response = s.handler(msg)
+		if response == nil {
+			return nil
+		}
+	}
+	// Let the peer match responses to its requests
+	if id, ok := msg["id"]; ok {
+		response["id"] = id
+	}
+	b, err := json.Marshal(response)
+	if err != nil {
+		log.Errorf("Failed to encode control response: %v\n", err)
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,65 @@
+package control
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermissions(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "permissions.json")
+	require.Nil(os.WriteFile(path, []byte(`{"operator": ["*"], "listener": ["get-devices"]}`), 0600))
+	p, err := LoadPermissions(path)
+	require.Nil(err)
+
+	require.True(p.Allowed("operator", "start-audio-stream"))
+	require.True(p.Allowed("listener", "get-devices"))
+	require.False(p.Allowed("listener", "start-audio-stream"))
+	require.False(p.Allowed("stranger", "get-devices"))
+
+	p.Grant("stranger", "get-devices")
+	require.True(p.Allowed("stranger", "get-devices"))
+	p.Revoke("stranger")
+	require.False(p.Allowed("stranger", "get-devices"))
+}
+
+func TestHandle(t *testing.T) {
+	require := require.New(t)
+
+	p := NewPermissions()
+	p.Grant("listener", "get-devices")
+	s := NewServer(p, func(msg map[string]interface{}) map[string]interface{} {
+		if msg["action"] != "get-devices" {
+			return nil
+		}
+		return map[string]interface{}{"action": "get-devices-response", "data": []string{"hw:0"}}
+	})
+
+	decode := func(b []byte) map[string]interface{} {
+		require.NotNil(b)
+		response := make(map[string]interface{})
+		require.Nil(json.Unmarshal(b, &response))
+		return response
+	}
+
+	response := decode(s.handle("listener", []byte(`{"action": "get-devices", "id": 7}`)))
+	require.Equal("get-devices-response", response["action"])
+	require.Equal(float64(7), response["id"])
+
+	response = decode(s.handle("listener", []byte(`{"action": "start-audio-stream", "data": "hw:0"}`)))
+	require.Equal(ActionDenied, response["action"])
+	require.Equal("start-audio-stream", response["data"])
+	require.NotEmpty(response["error"])
+
+	response = decode(s.handle("stranger", []byte(`{"action": "get-devices"}`)))
+	require.Equal(ActionDenied, response["action"])
+
+	require.Nil(s.handle("listener", []byte(`not json`)))
+	p.Grant("listener", "unknown")
+	require.Nil(s.handle("listener", []byte(`{"action": "unknown"}`)))
+}
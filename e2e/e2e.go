@@ -0,0 +1,304 @@
+// Package e2e seals signal payloads between peers so that the signaling
+// server relaying them can neither read nor tamper with them.
+//
+// Payloads are sealed with NaCl box (Curve25519, XSalsa20 and Poly1305).
+// Every sealed packet carries the sender's public key. The receiver checks
+// it against the key pinned for the sender's ID before opening the packet.
+package e2e
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	p2p "github.com/gurupras/dhwani_backend_p2p"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	envelopeVersion = 1
+	// maxClockSkew bounds how old (or how far in the future) a sealed packet may be
+	maxClockSkew = 2 * time.Minute
+	// maxUnpinned bounds how many unpinned senders' keys an optional Sealer remembers
+	maxUnpinned = 1024
+)
+
+var (
+	// ErrUnknownPeer is returned when no key is pinned for a peer and sealing is required
+	ErrUnknownPeer = errors.New("no key pinned for peer")
+	// ErrKeyMismatch is returned when a packet is sealed with a key other than the one pinned for its sender
+	ErrKeyMismatch = errors.New("sender key does not match pinned key")
+	// ErrNotSealed is returned for plaintext packets when sealing is required
+	ErrNotSealed = errors.New("packet is not sealed")
+	// ErrTampered is returned when a packet fails authentication or its header was altered
+	ErrTampered = errors.New("packet was tampered with")
+)
+
+// PublicKey identifies a peer
+type PublicKey [32]byte
+
+func (k PublicKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// ParsePublicKey parses the base64 form returned by PublicKey.String
+func ParsePublicKey(s string) (PublicKey, error) {
+	var key PublicKey
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return key, err
+	}
+	if len(b) != len(key) {
+		return key, fmt.Errorf("bad key length %v", len(b))
+	}
+	copy(key[:], b)
+	return key, nil
+}
+
+// KeyPair is the Curve25519 keypair a peer seals and opens packets with
+type KeyPair struct {
+	Public  PublicKey
+	Private [32]byte
+}
+
+// GenerateKeyPair creates a new random KeyPair
+func GenerateKeyPair() (*KeyPair, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Public: *pub, Private: *priv}, nil
+}
+
+// Keyring holds the public keys we trust for each peer ID
+type Keyring interface {
+	Lookup(id string) (PublicKey, bool)
+	Pin(id string, key PublicKey) error
+}
+
+// MemoryKeyring is a Keyring that lives in memory
+type MemoryKeyring struct {
+	mutex sync.Mutex
+	keys  map[string]PublicKey
+}
+
+func NewMemoryKeyring() *MemoryKeyring {
+	return &MemoryKeyring{
+		keys: make(map[string]PublicKey),
+	}
+}
+
+func (m *MemoryKeyring) Lookup(id string) (PublicKey, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key, ok := m.keys[id]
+	return key, ok
+}
+
+func (m *MemoryKeyring) Pin(id string, key PublicKey) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.keys[id] = key
+	return nil
+}
+
+// Options controls how strictly a Sealer treats peers
+type Options struct {
+	// Optional lets packets to and from peers without a pinned key travel in
+	// the clear. Sealed packets from such peers are still opened, and replies
+	// to them sealed with the key they presented, without pinning it.
+	Optional bool
+	// TrustOnFirstUse pins the key of a peer the first time it sends a sealed packet
+	TrustOnFirstUse bool
+}
+
+// Sealer seals outgoing and opens incoming signal packets. It implements p2p.PacketSealer.
+type Sealer struct {
+	keys    *KeyPair
+	keyring Keyring
+	opts    Options
+	now     func() time.Time
+
+	mutex sync.Mutex
+	// unpinned holds the keys unpinned peers last sealed with, so that we
+	// can seal our replies to them
+	unpinned map[string]PublicKey
+}
+
+func NewSealer(keys *KeyPair, keyring Keyring, opts Options) *Sealer {
+	return &Sealer{
+		keys:     keys,
+		keyring:  keyring,
+		opts:     opts,
+		now:      time.Now,
+		unpinned: make(map[string]PublicKey),
+	}
+}
+
+// lookup returns the key to seal for id with, if any
+func (s *Sealer) lookup(id string) (PublicKey, bool) {
+	if key, ok := s.keyring.Lookup(id); ok {
+		return key, true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key, ok := s.unpinned[id]
+	return key, ok
+}
+
+// remember keeps the key an unpinned peer sealed with, forgetting some other
+// peer's if too many are held
+func (s *Sealer) remember(id string, key PublicKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.unpinned[id]; !ok && len(s.unpinned) >= maxUnpinned {
+		for other := range s.unpinned {
+			delete(s.unpinned, other)
+			break
+		}
+	}
+	s.unpinned[id] = key
+}
+
+// envelope is what a sealed packet's Data decodes to
+type envelope struct {
+	Version int    `json:"v"`
+	Key     string `json:"key"`
+	Nonce   string `json:"nonce"`
+	Box     string `json:"box"`
+}
+
+// sealedContent is the plaintext inside the box. It repeats the packet's
+// header so that the relay cannot redirect or retype a sealed payload.
+type sealedContent struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Type      string `json:"type"`
+	Data      string `json:"data"`
+	Timestamp int64  `json:"ts"`
+}
+
+// Seal encrypts sp.Data for sp.To
+func (s *Sealer) Seal(sp p2p.SignalPacket) (p2p.SignalPacket, error) {
+	peerKey, ok := s.lookup(sp.To)
+	if !ok {
+		if s.opts.Optional {
+			return sp, nil
+		}
+		return sp, fmt.Errorf("cannot seal for '%v': %w", sp.To, ErrUnknownPeer)
+	}
+	plaintext, err := json.Marshal(sealedContent{
+		From:      sp.From,
+		To:        sp.To,
+		Type:      sp.Type,
+		Data:      sp.Data,
+		Timestamp: s.now().Unix(),
+	})
+	if err != nil {
+		return sp, err
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return sp, err
+	}
+	peer := [32]byte(peerKey)
+	sealed := box.Seal(nil, plaintext, &nonce, &peer, &s.keys.Private)
+	b, err := json.Marshal(envelope{
+		Version: envelopeVersion,
+		Key:     s.keys.Public.String(),
+		Nonce:   base64.StdEncoding.EncodeToString(nonce[:]),
+		Box:     base64.StdEncoding.EncodeToString(sealed),
+	})
+	if err != nil {
+		return sp, err
+	}
+	sp.Data = base64.StdEncoding.EncodeToString(b)
+	sp.Sealed = true
+	return sp, nil
+}
+
+// Open verifies the sender of sp and decrypts sp.Data
+func (s *Sealer) Open(sp p2p.SignalPacket) (p2p.SignalPacket, error) {
+	if !sp.Sealed {
+		if s.opts.Optional {
+			if _, pinned := s.keyring.Lookup(sp.From); !pinned {
+				return sp, nil
+			}
+		}
+		// Once a peer is pinned it must always seal, otherwise the relay could strip the seal
+		return sp, fmt.Errorf("packet from '%v': %w", sp.From, ErrNotSealed)
+	}
+	env, err := decodeEnvelope(sp.Data)
+	if err != nil {
+		return sp, fmt.Errorf("bad sealed packet from '%v': %w", sp.From, err)
+	}
+	senderKey, err := ParsePublicKey(env.Key)
+	if err != nil {
+		return sp, fmt.Errorf("bad sender key from '%v': %w", sp.From, err)
+	}
+	pinned, ok := s.keyring.Lookup(sp.From)
+	if !ok && !s.opts.TrustOnFirstUse && !s.opts.Optional {
+		return sp, fmt.Errorf("packet from '%v': %w", sp.From, ErrUnknownPeer)
+	}
+	if ok && pinned != senderKey {
+		return sp, fmt.Errorf("packet from '%v': %w", sp.From, ErrKeyMismatch)
+	}
+
+	nonceBytes, err := base64.StdEncoding.DecodeString(env.Nonce)
+	if err != nil || len(nonceBytes) != 24 {
+		return sp, fmt.Errorf("bad nonce from '%v'", sp.From)
+	}
+	boxBytes, err := base64.StdEncoding.DecodeString(env.Box)
+	if err != nil {
+		return sp, fmt.Errorf("bad box from '%v': %w", sp.From, err)
+	}
+	var nonce [24]byte
+	copy(nonce[:], nonceBytes)
+	sender := [32]byte(senderKey)
+	plaintext, opened := box.Open(nil, boxBytes, &nonce, &sender, &s.keys.Private)
+	if !opened {
+		return sp, fmt.Errorf("packet from '%v': %w", sp.From, ErrTampered)
+	}
+	var content sealedContent
+	if err := json.Unmarshal(plaintext, &content); err != nil {
+		return sp, fmt.Errorf("bad sealed content from '%v': %w", sp.From, err)
+	}
+	if content.From != sp.From || content.To != sp.To || content.Type != sp.Type {
+		return sp, fmt.Errorf("packet from '%v': header mismatch: %w", sp.From, ErrTampered)
+	}
+	age := s.now().Sub(time.Unix(content.Timestamp, 0))
+	if age > maxClockSkew || age < -maxClockSkew {
+		return sp, fmt.Errorf("packet from '%v' is %v old: %w", sp.From, age, ErrTampered)
+	}
+
+	// Only pin once the packet proved it holds the private key
+	if !ok && s.opts.TrustOnFirstUse {
+		if err := s.keyring.Pin(sp.From, senderKey); err != nil {
+			return sp, fmt.Errorf("failed to pin key of '%v': %w", sp.From, err)
+		}
+	} else if !ok {
+		s.remember(sp.From, senderKey)
+	}
+	sp.Data = content.Data
+	sp.Sealed = false
+	return sp, nil
+}
+
+func decodeEnvelope(data string) (envelope, error) {
+	var env envelope
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return env, err
+	}
+	if err := json.Unmarshal(b, &env); err != nil {
+		return env, err
+	}
+	if env.Version != envelopeVersion {
+		return env, fmt.Errorf("unsupported version %v", env.Version)
+	}
+	return env, nil
+}
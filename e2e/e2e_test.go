@@ -0,0 +1,136 @@
+package e2e
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	p2p "github.com/gurupras/dhwani_backend_p2p"
+	"github.com/stretchr/testify/require"
+)
+
+func newPeer(t *testing.T, opts Options) (*KeyPair, *MemoryKeyring, *Sealer) {
+	keys, err := GenerateKeyPair()
+	require.Nil(t, err)
+	keyring := NewMemoryKeyring()
+	return keys, keyring, NewSealer(keys, keyring, opts)
+}
+
+func TestSealOpen(t *testing.T) {
+	require := require.New(t)
+
+	aliceKeys, aliceRing, alice := newPeer(t, Options{})
+	bobKeys, bobRing, bob := newPeer(t, Options{})
+	aliceRing.Pin("bob", bobKeys.Public)
+	bobRing.Pin("alice", aliceKeys.Public)
+
+	sp := p2p.SignalPacket{From: "alice", To: "bob", Type: "offer", Data: "secret sdp"}
+	sealed, err := alice.Seal(sp)
+	require.Nil(err)
+	require.True(sealed.Sealed)
+	require.NotContains(sealed.Data, "secret")
+
+	opened, err := bob.Open(sealed)
+	require.Nil(err)
+	require.Equal(sp, opened)
+
+	// The relay cannot retype or redirect the packet
+	retyped := sealed
+	retyped.Type = "candidate"
+	_, err = bob.Open(retyped)
+	require.True(errors.Is(err, ErrTampered))
+
+	// Nor strip the seal once the peer is pinned
+	_, err = bob.Open(sp)
+	require.True(errors.Is(err, ErrNotSealed))
+
+	// Nor swap in its own key
+	_, _, mallory := newPeer(t, Options{})
+	malloryRing := mallory.keyring.(*MemoryKeyring)
+	malloryRing.Pin("bob", bobKeys.Public)
+	forged, err := mallory.Seal(p2p.SignalPacket{From: "alice", To: "bob", Type: "offer", Data: "evil"})
+	require.Nil(err)
+	_, err = bob.Open(forged)
+	require.True(errors.Is(err, ErrKeyMismatch))
+
+	// Unknown peers cannot be sealed for unless sealing is optional
+	_, err = alice.Seal(p2p.SignalPacket{From: "alice", To: "carol", Type: "offer"})
+	require.True(errors.Is(err, ErrUnknownPeer))
+}
+
+func TestStalePacket(t *testing.T) {
+	require := require.New(t)
+
+	aliceKeys, aliceRing, alice := newPeer(t, Options{})
+	bobKeys, bobRing, bob := newPeer(t, Options{})
+	aliceRing.Pin("bob", bobKeys.Public)
+	bobRing.Pin("alice", aliceKeys.Public)
+
+	alice.now = func() time.Time {
+		return time.Now().Add(-time.Hour)
+	}
+	sealed, err := alice.Seal(p2p.SignalPacket{From: "alice", To: "bob", Type: "offer", Data: "x"})
+	require.Nil(err)
+	_, err = bob.Open(sealed)
+	require.True(errors.Is(err, ErrTampered))
+}
+
+func TestOptionalAndTrustOnFirstUse(t *testing.T) {
+	require := require.New(t)
+
+	aliceKeys, aliceRing, alice := newPeer(t, Options{Optional: true})
+	_, bobRing, bob := newPeer(t, Options{Optional: true, TrustOnFirstUse: true})
+
+	// Neither knows the other: packets travel in the clear
+	sp := p2p.SignalPacket{From: "bob", To: "alice", Type: "offer", Data: "x"}
+	out, err := bob.Seal(sp)
+	require.Nil(err)
+	require.False(out.Sealed)
+	in, err := alice.Open(out)
+	require.Nil(err)
+	require.Equal(sp, in)
+
+	// Once alice knows bob's key, bob learns hers from the first sealed packet
+	aliceRing.Pin("bob", bob.keys.Public)
+	out, err = alice.Seal(p2p.SignalPacket{From: "alice", To: "bob", Type: "answer", Data: "y"})
+	require.Nil(err)
+	require.True(out.Sealed)
+	in, err = bob.Open(out)
+	require.Nil(err)
+	require.Equal("y", in.Data)
+	pinned, ok := bobRing.Lookup("alice")
+	require.True(ok)
+	require.Equal(aliceKeys.Public, pinned)
+}
+
+func TestOneSidedPairing(t *testing.T) {
+	require := require.New(t)
+
+	// Only the listener pinned the broadcaster
+	_, listenerRing, listener := newPeer(t, Options{Optional: true})
+	broadcasterKeys, broadcasterRing, broadcaster := newPeer(t, Options{Optional: true})
+	listenerRing.Pin("broadcaster", broadcasterKeys.Public)
+
+	offer, err := listener.Seal(p2p.SignalPacket{From: "listener", To: "broadcaster", Type: "offer", Data: "x"})
+	require.Nil(err)
+	require.True(offer.Sealed)
+	in, err := broadcaster.Open(offer)
+	require.Nil(err)
+	require.Equal("x", in.Data)
+	// The listener's key is used for replies but not pinned
+	_, ok := broadcasterRing.Lookup("listener")
+	require.False(ok)
+
+	answer, err := broadcaster.Seal(p2p.SignalPacket{From: "broadcaster", To: "listener", Type: "answer", Data: "y"})
+	require.Nil(err)
+	require.True(answer.Sealed)
+	in, err = listener.Open(answer)
+	require.Nil(err)
+	require.Equal("y", in.Data)
+
+	// Unpinned peers may still signal in the clear
+	sp := p2p.SignalPacket{From: "carol", To: "broadcaster", Type: "offer", Data: "z"}
+	in, err = broadcaster.Open(sp)
+	require.Nil(err)
+	require.Equal(sp, in)
+}
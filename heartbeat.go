@@ -0,0 +1,104 @@
+package dhwani_backend_p2p
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type heartbeatConfig struct {
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func newHeartbeatConfig(opts ServerOptions) heartbeatConfig {
+	cfg := heartbeatConfig{
+		interval: opts.HeartbeatInterval,
+		timeout:  opts.HeartbeatTimeout,
+	}
+	if cfg.timeout <= 0 {
+		cfg.timeout = defaultHeartbeatTimeout
+	}
+	return cfg
+}
+
+// RTT returns the round-trip time measured by the last successful heartbeat,
+// or 0 if none has completed yet
+func (s *ServerConn) RTT() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rtt
+}
+
+// startHeartbeat pings the server until the returned function is called
+func (s *ServerConn) startHeartbeat() func() {
+	if s.heartbeat.interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.heartbeat.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if s.State() != StateConnected {
+				continue
+			}
+			if err := s.ping(); err != nil {
+				log.Warnf("Heartbeat failed: %v\n", err)
+				s.forceReconnect(err)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+func (s *ServerConn) ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.heartbeat.timeout)
+	defer cancel()
+	start := time.Now()
+	_, err := s.request(ctx, func(id string) interface{} {
+		return PingMessage{Action: ActionPing, ID: id}
+	})
+	if err != nil {
+		return err
+	}
+	rtt := time.Since(start)
+	s.mutex.Lock()
+	s.rtt = rtt
+	s.mutex.Unlock()
+	log.Debugf("Signaling RTT: %v\n", rtt)
+	return nil
+}
+
+// forceReconnect tears down a connection that stopped answering. Connections
+// that cannot reconnect are closed, which ends Loop.
+func (s *ServerConn) forceReconnect(cause error) {
+	s.mutex.Lock()
+	s.rtt = 0
+	s.mutex.Unlock()
+	if r, ok := s.ServerConnection.(*reconnectingConn); ok {
+		r.reconnect(cause)
+		return
+	}
+	s.ServerConnection.Close()
+}
+
+func (s *ServerConn) handlePong(raw json.RawMessage) error {
+	var msg PingMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return err
+	}
+	if !s.resolve(msg.ID, raw, nil) {
+		log.Debugf("Ignoring late pong '%v'\n", msg.ID)
+	}
+	return nil
+}
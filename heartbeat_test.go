@@ -0,0 +1,80 @@
+package dhwani_backend_p2p
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeartbeat(t *testing.T) {
+	require := require.New(t)
+
+	var connections int32
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// The first connection goes silent after two pongs, like a half-open socket
+		first := atomic.AddInt32(&connections, 1) == 1
+		pongs := 0
+		for {
+			_, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var ping PingMessage
+			json.Unmarshal(b, &ping)
+			if ping.Action != ActionPing || (first && pongs >= 2) {
+				continue
+			}
+			pongs++
+			b, _ = json.Marshal(PingMessage{Action: ActionPong, ID: ping.ID})
+			conn.WriteMessage(websocket.TextMessage, b)
+		}
+	}))
+	defer server.Close()
+
+	conn, err := NewServerConnectionWithOptions("b", ServerOptions{
+		URL:               "ws" + strings.TrimPrefix(server.URL, "http"),
+		DialTimeout:       time.Second,
+		AutoReconnect:     true,
+		Backoff:           Backoff{Min: 10 * time.Millisecond},
+		HeartbeatInterval: 20 * time.Millisecond,
+		HeartbeatTimeout:  50 * time.Millisecond,
+	})
+	require.Nil(err)
+	defer conn.Close()
+	disconnected := make(chan struct{}, 1)
+	conn.OnStateChange(func(state ConnState) {
+		if state == StateDisconnected {
+			select {
+			case disconnected <- struct{}{}:
+			default:
+			}
+		}
+	})
+	go conn.Loop()
+
+	require.Eventually(func() bool {
+		return conn.RTT() > 0
+	}, 2*time.Second, 5*time.Millisecond)
+
+	select {
+	case <-disconnected:
+	case <-time.After(2 * time.Second):
+		require.Fail("missing pongs did not tear down the connection")
+	}
+	require.Eventually(func() bool {
+		return atomic.LoadInt32(&connections) == 2 && conn.State() == StateConnected && conn.RTT() > 0
+	}, 2*time.Second, 5*time.Millisecond)
+}
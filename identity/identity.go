@@ -0,0 +1,127 @@
+// Package identity gives a peer a persistent keypair and derives its
+// signaling ID and pairing code from the public key.
+//
+// The ID is only about 30 bits of the key's hash, short enough that anyone
+// can grind a keypair for a chosen ID. It routes signals but authenticates
+// nothing: a peer is trusted only once its pairing code, which covers more of
+// the hash, has been compared out of band and its key pinned.
+package identity
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gurupras/dhwani_backend_p2p/e2e"
+)
+
+const (
+	identityFile = "identity.json"
+	// IDLength matches the 9 digit IDs the signaling server has always used
+	IDLength = 9
+)
+
+// Identity is a peer's keypair along with the ID derived from it
+type Identity struct {
+	ID   string
+	Keys *e2e.KeyPair
+}
+
+type identityJSON struct {
+	Public  string `json:"public"`
+	Private string `json:"private"`
+}
+
+// DeriveID returns the signaling ID that belongs to key. Many keys share an
+// ID, so a matching ID alone does not vouch for a key
+func DeriveID(key e2e.PublicKey) string {
+	sum := sha256.Sum256(key[:])
+	n := binary.BigEndian.Uint64(sum[:8]) % 1000000000
+	return fmt.Sprintf("%0*d", IDLength, n)
+}
+
+// PairingCode returns the short code a user compares to confirm key, e.g. ABCD-EFGH
+func PairingCode(key e2e.PublicKey) string {
+	sum := sha256.Sum256(key[:])
+	// Use bytes the ID does not depend on
+	code := base32.StdEncoding.EncodeToString(sum[8:13])
+	return code[:4] + "-" + code[4:8]
+}
+
+// MatchesPairingCode reports whether code, as typed by a user, belongs to key
+func MatchesPairingCode(key e2e.PublicKey, code string) bool {
+	normalize := func(s string) string {
+		s = strings.ToUpper(s)
+		s = strings.ReplaceAll(s, "-", "")
+		return strings.ReplaceAll(s, " ", "")
+	}
+	return normalize(code) == normalize(PairingCode(key))
+}
+
+// PairingCode returns this identity's pairing code
+func (i *Identity) PairingCode() string {
+	return PairingCode(i.Keys.Public)
+}
+
+// LoadOrCreate loads the identity stored in dir, creating and saving a new
+// one on first run
+func LoadOrCreate(dir string) (*Identity, error) {
+	path := filepath.Join(dir, identityFile)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return create(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored identityJSON
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return nil, fmt.Errorf("bad identity file '%v': %w", path, err)
+	}
+	pub, err := e2e.ParsePublicKey(stored.Public)
+	if err != nil {
+		return nil, fmt.Errorf("bad public key in '%v': %w", path, err)
+	}
+	priv, err := base64.StdEncoding.DecodeString(stored.Private)
+	if err != nil || len(priv) != 32 {
+		return nil, fmt.Errorf("bad private key in '%v'", path)
+	}
+	keys := &e2e.KeyPair{Public: pub}
+	copy(keys.Private[:], priv)
+	return &Identity{ID: DeriveID(pub), Keys: keys}, nil
+}
+
+func create(dir string) (*Identity, error) {
+	keys, err := e2e.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	b, _ := json.MarshalIndent(identityJSON{
+		Public:  keys.Public.String(),
+		Private: base64.StdEncoding.EncodeToString(keys.Private[:]),
+	}, "", "  ")
+	if err := writeFileAtomic(filepath.Join(dir, identityFile), b); err != nil {
+		return nil, err
+	}
+	return &Identity{ID: DeriveID(keys.Public), Keys: keys}, nil
+}
+
+// writeFileAtomic writes b to path through a temporary file so that a crash
+// never leaves a truncated file behind
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,115 @@
+package identity
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	p2p "github.com/gurupras/dhwani_backend_p2p"
+	"github.com/gurupras/dhwani_backend_p2p/e2e"
+	"github.com/gurupras/dhwani_backend_p2p/signalserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOrCreate(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+
+	id, err := LoadOrCreate(dir)
+	require.Nil(err)
+	require.Len(id.ID, IDLength)
+	require.Equal(DeriveID(id.Keys.Public), id.ID)
+
+	again, err := LoadOrCreate(dir)
+	require.Nil(err)
+	require.Equal(id.ID, again.ID)
+	require.Equal(id.Keys, again.Keys)
+
+	other, err := LoadOrCreate(t.TempDir())
+	require.Nil(err)
+	require.NotEqual(id.ID, other.ID)
+}
+
+func TestPairingCode(t *testing.T) {
+	require := require.New(t)
+
+	keys, err := e2e.GenerateKeyPair()
+	require.Nil(err)
+	code := PairingCode(keys.Public)
+	require.Len(code, 9)
+	require.True(MatchesPairingCode(keys.Public, code))
+	require.True(MatchesPairingCode(keys.Public, " "+code[:4]+code[5:]+" "))
+
+	other, err := e2e.GenerateKeyPair()
+	require.Nil(err)
+	require.False(MatchesPairingCode(other.Public, code))
+}
+
+func TestFileKeyring(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+
+	keys, err := e2e.GenerateKeyPair()
+	require.Nil(err)
+	impostor, err := e2e.GenerateKeyPair()
+	require.Nil(err)
+	id := DeriveID(keys.Public)
+
+	keyring, err := OpenKeyring(dir)
+	require.Nil(err)
+	require.NotNil(keyring.Pin(id, impostor.Public))
+	require.Nil(keyring.Pin(id, keys.Public))
+
+	keyring, err = OpenKeyring(dir)
+	require.Nil(err)
+	key, ok := keyring.Lookup(id)
+	require.True(ok)
+	require.Equal(keys.Public, key)
+	require.Nil(keyring.Pin(id, keys.Public))
+
+	require.Nil(keyring.Unpin(id))
+	_, ok = keyring.Lookup(id)
+	require.False(ok)
+}
+
+func TestPair(t *testing.T) {
+	require := require.New(t)
+
+	server := signalserver.New()
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+
+	broadcaster, err := LoadOrCreate(t.TempDir())
+	require.Nil(err)
+	listener, err := LoadOrCreate(t.TempDir())
+	require.Nil(err)
+
+	broadcasterConn, err := p2p.NewServerConnectionWithOptions(broadcaster.ID, p2p.ServerOptions{URL: url})
+	require.Nil(err)
+	defer broadcasterConn.Close()
+	ServeIdentity(broadcasterConn, broadcaster)
+	go broadcasterConn.Loop()
+
+	listenerConn, err := p2p.NewServerConnectionWithOptions(listener.ID, p2p.ServerOptions{URL: url})
+	require.Nil(err)
+	defer listenerConn.Close()
+	go listenerConn.Loop()
+
+	keyring, err := OpenKeyring(t.TempDir())
+	require.Nil(err)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	require.NotNil(Pair(ctx, listenerConn, keyring, broadcaster.ID, "AAAA-AAAA"))
+	_, ok := keyring.Lookup(broadcaster.ID)
+	require.False(ok)
+
+	require.Nil(Pair(ctx, listenerConn, keyring, broadcaster.ID, broadcaster.PairingCode()))
+	key, ok := keyring.Lookup(broadcaster.ID)
+	require.True(ok)
+	require.Equal(broadcaster.Keys.Public, key)
+}
@@ -0,0 +1,95 @@
+package identity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gurupras/dhwani_backend_p2p/e2e"
+)
+
+const pinsFile = "pins.json"
+
+// FileKeyring is an e2e.Keyring persisted next to the identity. A pinned
+// key can only be replaced by Unpin followed by a new Pin.
+type FileKeyring struct {
+	path  string
+	mutex sync.Mutex
+	keys  map[string]e2e.PublicKey
+}
+
+// OpenKeyring loads the pins stored in dir
+func OpenKeyring(dir string) (*FileKeyring, error) {
+	k := &FileKeyring{
+		path: filepath.Join(dir, pinsFile),
+		keys: make(map[string]e2e.PublicKey),
+	}
+	b, err := os.ReadFile(k.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]string)
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return nil, fmt.Errorf("bad pins file '%v': %w", k.path, err)
+	}
+	for id, raw := range stored {
+		key, err := e2e.ParsePublicKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("bad key for '%v' in '%v': %w", id, k.path, err)
+		}
+		k.keys[id] = key
+	}
+	return k, nil
+}
+
+func (k *FileKeyring) Lookup(id string) (e2e.PublicKey, bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// Pin trusts key for id. Keys whose derived ID differs from id are refused,
+// as are attempts to replace an existing pin.
+func (k *FileKeyring) Pin(id string, key e2e.PublicKey) error {
+	if DeriveID(key) != id {
+		return fmt.Errorf("key does not belong to '%v'", id)
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if existing, ok := k.keys[id]; ok {
+		if existing == key {
+			return nil
+		}
+		return fmt.Errorf("'%v': %w", id, e2e.ErrKeyMismatch)
+	}
+	k.keys[id] = key
+	return k.save()
+}
+
+// Unpin forgets the key of id
+func (k *FileKeyring) Unpin(id string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	delete(k.keys, id)
+	return k.save()
+}
+
+// save must be called with mutex held
+func (k *FileKeyring) save() error {
+	stored := make(map[string]string, len(k.keys))
+	for id, key := range k.keys {
+		stored[id] = key.String()
+	}
+	b, _ := json.MarshalIndent(stored, "", "  ")
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(k.path, b)
+}
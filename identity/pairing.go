@@ -0,0 +1,88 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+
+	p2p "github.com/gurupras/dhwani_backend_p2p"
+	"github.com/gurupras/dhwani_backend_p2p/e2e"
+	log "github.com/sirupsen/logrus"
+)
+
+// Signal types used to exchange identities
+const (
+	SignalIdentify = "identify"
+	SignalIdentity = "identity"
+)
+
+// ServeIdentity answers identify requests from other peers with our public key.
+// The returned function stops answering.
+func ServeIdentity(conn *p2p.ServerConn, id *Identity) func() {
+	return conn.OnSignal(func(sp p2p.SignalPacket) {
+		if sp.Type != SignalIdentify {
+			return
+		}
+		reply := p2p.SignalPacket{
+			To:   sp.From,
+			Type: SignalIdentity,
+			Data: id.Keys.Public.String(),
+		}
+		// We are on the connection's loop, which is what reads the ack
+		go func() {
+			if err := conn.SendSignal(context.Background(), reply); err != nil {
+				log.Errorf("Failed to send identity to '%v': %v\n", sp.From, err)
+			}
+		}()
+	})
+}
+
+// Pair asks peerID for its key, checks it against peerID and the pairing
+// code the user read off the peer, and pins it in keyring. Once pinned, a
+// peer presenting any other key is rejected.
+func Pair(ctx context.Context, conn *p2p.ServerConn, keyring e2e.Keyring, peerID string, code string) error {
+	if key, ok := keyring.Lookup(peerID); ok {
+		if !MatchesPairingCode(key, code) {
+			return fmt.Errorf("'%v' is already paired with a different key", peerID)
+		}
+		return nil
+	}
+
+	got := make(chan e2e.PublicKey, 1)
+	stop := conn.OnSignal(func(sp p2p.SignalPacket) {
+		if sp.Type != SignalIdentity || sp.From != peerID {
+			return
+		}
+		key, err := e2e.ParsePublicKey(sp.Data)
+		if err != nil {
+			log.Warnf("Bad identity from '%v': %v\n", sp.From, err)
+			return
+		}
+		select {
+		case got <- key:
+		default:
+		}
+	})
+	defer stop()
+
+	err := conn.SendSignal(ctx, p2p.SignalPacket{
+		To:   peerID,
+		Type: SignalIdentify,
+	})
+	if err != nil {
+		return err
+	}
+
+	var key e2e.PublicKey
+	select {
+	case key = <-got:
+	case <-ctx.Done():
+		return fmt.Errorf("no identity from '%v': %w", peerID, ctx.Err())
+	}
+	if DeriveID(key) != peerID {
+		return fmt.Errorf("'%v' presented a key that does not belong to it", peerID)
+	}
+	if !MatchesPairingCode(key, code) {
+		return fmt.Errorf("pairing code does not match '%v'", peerID)
+	}
+	return keyring.Pin(peerID, key)
+}
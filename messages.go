@@ -0,0 +1,135 @@
+package dhwani_backend_p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Actions understood by the signaling server
+const (
+	ActionSignal = "signal"
+	ActionError  = "error"
+	ActionAck    = "ack"
+
+	ActionJoin        = "join"
+	ActionLeave       = "leave"
+	ActionListRoom    = "list-room"
+	ActionRoomMembers = "room-members"
+	ActionPeerJoined  = "peer-joined"
+	ActionPeerLeft    = "peer-left"
+
+	ActionPing = "ping"
+	ActionPong = "pong"
+)
+
+// ErrUnknownAction is reported when a message carries an action nobody registered for
+var ErrUnknownAction = errors.New("unknown action")
+
+// Envelope is the header shared by every message exchanged with the signaling server
+type Envelope struct {
+	Action string `json:"action"`
+}
+
+// SignalMessage is the wire format of a SignalPacket.
+// ID correlates the server's ack or error with the message.
+type SignalMessage struct {
+	Action string `json:"action"`
+	ID     string `json:"id,omitempty"`
+	SignalPacket
+}
+
+// AckMessage is sent by the server once a message was delivered
+type AckMessage struct {
+	Action string `json:"action"`
+	ID     string `json:"id"`
+}
+
+// ErrorMessage is sent by the server when it could not act on a message
+type ErrorMessage struct {
+	Action string `json:"action"`
+	ID     string `json:"id,omitempty"`
+	Error  string `json:"error"`
+	To     string `json:"to,omitempty"`
+}
+
+// PingMessage is the heartbeat sent by clients. The server echoes the ID back in a pong.
+type PingMessage struct {
+	Action string `json:"action"`
+	ID     string `json:"id"`
+}
+
+// RoomMessage asks the server to join, leave or list a room
+type RoomMessage struct {
+	Action string `json:"action"`
+	ID     string `json:"id,omitempty"`
+	Room   string `json:"room"`
+}
+
+// RoomMembersMessage answers a join or list-room request with the other members of the room
+type RoomMembersMessage struct {
+	Action  string   `json:"action"`
+	ID      string   `json:"id,omitempty"`
+	Room    string   `json:"room"`
+	Members []string `json:"members"`
+}
+
+// PresenceMessage tells room members that a peer joined or left
+type PresenceMessage struct {
+	Action string `json:"action"`
+	Room   string `json:"room"`
+	Peer   string `json:"peer"`
+}
+
+// SignalError is returned when the server could not deliver a signal
+type SignalError struct {
+	To     string
+	Reason string
+}
+
+func (e *SignalError) Error() string {
+	return fmt.Sprintf("server error: %v", e.Reason)
+}
+
+// MessageError describes a message from the server that could not be handled
+type MessageError struct {
+	Action string
+	Raw    []byte
+	Err    error
+}
+
+func (e *MessageError) Error() string {
+	if e.Action == "" {
+		return fmt.Sprintf("bad message '%v': %v", string(e.Raw), e.Err)
+	}
+	return fmt.Sprintf("bad '%v' message '%v': %v", e.Action, string(e.Raw), e.Err)
+}
+
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
+
+func decodeEnvelope(raw []byte) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return env, err
+	}
+	if env.Action == "" {
+		return env, fmt.Errorf("missing 'action'")
+	}
+	return env, nil
+}
+
+func decodeSignalPacket(raw []byte) (SignalPacket, error) {
+	var msg SignalMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return SignalPacket{}, err
+	}
+	if msg.From == "" {
+		return SignalPacket{}, fmt.Errorf("missing 'from'")
+	}
+	if msg.Type == "" {
+		return SignalPacket{}, fmt.Errorf("missing 'type'")
+	}
+	return msg.SignalPacket, nil
+}
@@ -0,0 +1,140 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	p2p "github.com/gurupras/dhwani_backend_p2p"
+	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// SignalReject tells a remote peer that its offer was refused
+const SignalReject = "reject"
+
+// ErrTooManySessions rejects offers beyond Config.MaxSessions
+var ErrTooManySessions = errors.New("too many listeners")
+
+// AdmissionRequest is a remote peer without a session asking to connect
+type AdmissionRequest struct {
+	RemoteID string `json:"peer"`
+	// PIN is what the peer put in its offer, if anything
+	PIN string `json:"-"`
+	// Done, if set, is closed once the peer stops waiting for a decision.
+	// Policies that hold requests should withdraw it then
+	Done <-chan struct{} `json:"-"`
+}
+
+// Admit decides on req by calling decide exactly once, possibly later. A nil
+// error admits the peer. Any other error is signaled to it as the reason
+type Admit func(req AdmissionRequest, decide func(err error))
+
+// offerMessage is the payload of an offer signal
+type offerMessage struct {
+	webrtc.SessionDescription
+	PIN string `json:"pin,omitempty"`
+}
+
+// RejectMessage is the payload of a reject signal
+type RejectMessage struct {
+	Reason string `json:"reason"`
+}
+
+// admit runs the offer of a peer without a session through the admission policy
+func (m *PeerManager) admit(remoteID string, offer webrtc.SessionDescription, pin string) error {
+	if err := m.checkCapacity(remoteID); err != nil {
+		m.reject(remoteID, err)
+		return fmt.Errorf("rejected offer from '%v': %w", remoteID, err)
+	}
+	if m.config.Admit == nil {
+		return m.accept(remoteID, offer)
+	}
+
+	// A newer offer from the same peer supersedes one awaiting a decision
+	m.mutex.Lock()
+	m.admissions[remoteID]++
+	generation := m.admissions[remoteID]
+	m.mutex.Unlock()
+	m.config.Admit(AdmissionRequest{RemoteID: remoteID, PIN: pin}, func(err error) {
+		m.mutex.Lock()
+		current := m.admissions[remoteID] == generation
+		if current {
+			delete(m.admissions, remoteID)
+		}
+		m.mutex.Unlock()
+		if !current {
+			return
+		}
+		if err == nil {
+			err = m.checkCapacity(remoteID)
+		}
+		if err != nil {
+			log.Infof("Rejected offer from '%v': %v\n", remoteID, err)
+			m.reject(remoteID, err)
+			return
+		}
+		if err := m.accept(remoteID, offer); err != nil {
+			log.Errorf("%v\n", err)
+		}
+	})
+	return nil
+}
+
+// checkCapacity returns ErrTooManySessions if remoteID would exceed MaxSessions.
+// It saves admitting peers we have no room for. newSession has the final say
+func (m *PeerManager) checkCapacity(remoteID string) error {
+	if m.config.MaxSessions <= 0 {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.sessions[remoteID]; ok {
+		// Replacing a session does not add a listener
+		return nil
+	}
+	if len(m.sessions) >= m.config.MaxSessions {
+		return ErrTooManySessions
+	}
+	return nil
+}
+
+// accept creates a session with remoteID and answers its offer
+func (m *PeerManager) accept(remoteID string, offer webrtc.SessionDescription) error {
+	if m.config.OnRemoteCodecs != nil {
+		m.config.OnRemoteCodecs(remoteID, offeredCodecs(offer.SDP))
+	}
+	session, err := m.newSession(remoteID, sessionOptions{capped: true})
+	if errors.Is(err, ErrTooManySessions) {
+		m.reject(remoteID, err)
+		return fmt.Errorf("rejected offer from '%v': %w", remoteID, err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create session with '%v': %w", remoteID, err)
+	}
+	if err := m.answer(session, offer); err != nil {
+		m.remove(session)
+		session.close()
+		return fmt.Errorf("failed to answer '%v': %w", remoteID, err)
+	}
+	return nil
+}
+
+// reject signals remoteID why its offer was refused and drops its candidates
+func (m *PeerManager) reject(remoteID string, reason error) {
+	m.mutex.Lock()
+	m.takeEarlyLocked(remoteID)
+	m.mutex.Unlock()
+	data, err := EncodeJSON(RejectMessage{Reason: reason.Error()})
+	if err != nil {
+		log.Errorf("Failed to encode rejection: %v\n", err)
+		return
+	}
+	sp := p2p.SignalPacket{To: remoteID, Type: SignalReject, Data: data}
+	// Decisions may be made on the goroutine that delivers signals to us
+	go func() {
+		if err := m.signaler.SendSignal(context.Background(), sp); err != nil {
+			log.Errorf("Failed to send %v to '%v': %v\n", sp.Type, remoteID, err)
+		}
+	}()
+}
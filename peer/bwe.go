@@ -0,0 +1,133 @@
+package peer
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+const (
+	// Loss below lowLoss lets the estimate grow, loss above highLoss shrinks it
+	lowLoss  = 0.02
+	highLoss = 0.10
+	// increaseFactor is applied at most once every increaseInterval
+	increaseFactor   = 1.08
+	increaseInterval = 200 * time.Millisecond
+	// reportThreshold is the relative change worth telling OnBitrate about
+	reportThreshold = 0.05
+)
+
+// BitrateConfig bounds the bitrate we send each peer
+type BitrateConfig struct {
+	// Floor and Ceiling in bits per second. A zero Ceiling disables estimation
+	Floor   int
+	Ceiling int
+	// Initial is the estimate before any feedback. Defaults to Ceiling
+	Initial int
+}
+
+// estimator turns loss reports and REMB into a send bitrate, following the
+// loss-based controller of Google Congestion Control
+type estimator struct {
+	mutex        sync.Mutex
+	config       BitrateConfig
+	estimate     float64
+	remb         float64
+	lastIncrease time.Time
+	reported     int
+}
+
+func newEstimator(config BitrateConfig) *estimator {
+	initial := config.Initial
+	if initial <= 0 {
+		initial = config.Ceiling
+	}
+	return &estimator{
+		config:   config,
+		estimate: float64(initial),
+	}
+}
+
+// onLoss updates the estimate with the fraction of packets lost
+func (e *estimator) onLoss(fraction float64, now time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	switch {
+	case fraction < lowLoss:
+		if now.Sub(e.lastIncrease) >= increaseInterval {
+			e.estimate *= increaseFactor
+			e.lastIncrease = now
+		}
+	case fraction > highLoss:
+		e.estimate *= 1 - 0.5*fraction
+	}
+	e.estimate = e.clamp(e.estimate)
+}
+
+// onREMB caps the estimate at what the receiver says it can take
+func (e *estimator) onREMB(bitrate float64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.remb = bitrate
+}
+
+func (e *estimator) clamp(bitrate float64) float64 {
+	return math.Max(float64(e.config.Floor), math.Min(float64(e.config.Ceiling), bitrate))
+}
+
+// bitrate returns the current estimate
+func (e *estimator) bitrate() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	estimate := e.estimate
+	if e.remb > 0 {
+		estimate = math.Min(estimate, e.remb)
+	}
+	return int(e.clamp(estimate))
+}
+
+// changed returns the current estimate and whether it moved enough since it
+// was last reported to be worth reporting
+func (e *estimator) changed() (int, bool) {
+	bitrate := e.bitrate()
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.reported != 0 && math.Abs(float64(bitrate-e.reported)) < reportThreshold*float64(e.reported) {
+		return bitrate, false
+	}
+	e.reported = bitrate
+	return bitrate, true
+}
+
+// twccLoss returns the fraction of the packets covered by fb that were not received
+func twccLoss(fb *rtcp.TransportLayerCC) float64 {
+	total := int(fb.PacketStatusCount)
+	if total == 0 {
+		return 0
+	}
+	lost, counted := 0, 0
+	count := func(symbol uint16) {
+		if counted >= total {
+			return
+		}
+		counted++
+		if symbol == rtcp.TypeTCCPacketNotReceived {
+			lost++
+		}
+	}
+	for _, chunk := range fb.PacketChunks {
+		switch chunk := chunk.(type) {
+		case *rtcp.RunLengthChunk:
+			for i := 0; i < int(chunk.RunLength); i++ {
+				count(chunk.PacketStatusSymbol)
+			}
+		case *rtcp.StatusVectorChunk:
+			for _, symbol := range chunk.SymbolList {
+				count(symbol)
+			}
+		}
+	}
+	return float64(lost) / float64(total)
+}
@@ -0,0 +1,72 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimator(t *testing.T) {
+	require := require.New(t)
+
+	e := newEstimator(BitrateConfig{Floor: 16000, Ceiling: 128000, Initial: 64000})
+	bitrate, changed := e.changed()
+	require.Equal(64000, bitrate)
+	require.True(changed)
+
+	// Low loss grows the estimate, but not more often than increaseInterval
+	now := time.Now()
+	e.onLoss(0, now)
+	e.onLoss(0, now.Add(increaseInterval/2))
+	require.Equal(int(64000*increaseFactor), e.bitrate())
+	_, changed = e.changed()
+	require.True(changed)
+
+	// Moderate loss holds it
+	e.onLoss(0.05, now.Add(time.Second))
+	require.Equal(int(64000*increaseFactor), e.bitrate())
+	_, changed = e.changed()
+	require.False(changed)
+
+	// Heavy loss cuts it, never below the floor
+	for i := 0; i < 20; i++ {
+		e.onLoss(0.5, now.Add(time.Second))
+	}
+	require.Equal(16000, e.bitrate())
+
+	for i := 0; i < 100; i++ {
+		e.onLoss(0, now.Add(time.Duration(i+2)*time.Second))
+	}
+	require.Equal(128000, e.bitrate())
+
+	// REMB caps the estimate
+	e.onREMB(40000)
+	require.Equal(40000, e.bitrate())
+	e.onREMB(1000)
+	require.Equal(16000, e.bitrate())
+}
+
+func TestTWCCLoss(t *testing.T) {
+	require := require.New(t)
+
+	require.Zero(twccLoss(&rtcp.TransportLayerCC{}))
+	fb := &rtcp.TransportLayerCC{
+		PacketStatusCount: 10,
+		PacketChunks: []rtcp.PacketStatusChunk{
+			&rtcp.RunLengthChunk{PacketStatusSymbol: rtcp.TypeTCCPacketReceivedSmallDelta, RunLength: 6},
+			&rtcp.StatusVectorChunk{
+				SymbolSize: rtcp.TypeTCCSymbolSizeTwoBit,
+				// The padding past PacketStatusCount is not counted
+				SymbolList: []uint16{
+					rtcp.TypeTCCPacketNotReceived, rtcp.TypeTCCPacketReceivedSmallDelta,
+					rtcp.TypeTCCPacketNotReceived, rtcp.TypeTCCPacketReceivedLargeDelta,
+					rtcp.TypeTCCPacketNotReceived, rtcp.TypeTCCPacketNotReceived,
+					rtcp.TypeTCCPacketNotReceived,
+				},
+			},
+		},
+	}
+	require.InDelta(0.2, twccLoss(fb), 0.001)
+}
@@ -0,0 +1,124 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// CallOptions configure Call
+type CallOptions struct {
+	// PIN is sent in our offers for peers that require one
+	PIN string
+	// MinBackoff and MaxBackoff bound the wait before redialing. The wait
+	// doubles after every attempt that did not connect
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// ConnectTimeout gives up on an attempt that has not connected in time. 0 waits forever
+	ConnectTimeout time.Duration
+}
+
+// Dial starts a session with remoteID by sending it an offer
+func (m *PeerManager) Dial(remoteID string, pin string) (*Session, error) {
+	session, err := m.newSession(remoteID, sessionOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session with '%v': %w", remoteID, err)
+	}
+	session.pin = pin
+	if len(session.PeerConnection.GetTransceivers()) == 0 {
+		// An offer needs a media section. Without tracks of our own, we offer to listen
+		if _, err := session.PeerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			m.remove(session)
+			session.close()
+			return nil, fmt.Errorf("failed to add transceiver for '%v': %w", remoteID, err)
+		}
+	}
+	if err := session.negotiate(); err != nil {
+		m.remove(session)
+		session.close()
+		return nil, fmt.Errorf("failed to offer to '%v': %w", remoteID, err)
+	}
+	return session, nil
+}
+
+// Call keeps a session with remoteID until ctx is done, redialing with
+// backoff whenever the session fails or closes. The session is closed when
+// ctx is done.
+func (m *PeerManager) Call(ctx context.Context, remoteID string, options CallOptions) {
+	if options.MinBackoff <= 0 {
+		options.MinBackoff = time.Second
+	}
+	if options.MaxBackoff < options.MinBackoff {
+		options.MaxBackoff = options.MinBackoff
+	}
+	backoff := options.MinBackoff
+	for {
+		session, err := m.Dial(remoteID, options.PIN)
+		if err != nil {
+			log.Errorf("%v\n", err)
+		} else if m.await(ctx, session, options.ConnectTimeout) {
+			backoff = options.MinBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		log.Infof("Redialing '%v'\n", remoteID)
+		backoff *= 2
+		if backoff > options.MaxBackoff {
+			backoff = options.MaxBackoff
+		}
+	}
+}
+
+// await waits for session to end, returning whether it connected. A session
+// that is replaced by one the remote peer offered is followed instead.
+func (m *PeerManager) await(ctx context.Context, session *Session, timeout time.Duration) bool {
+	connected := false
+	connectedCh := session.connected
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			m.remove(session)
+			session.close()
+			return connected
+		case <-connectedCh:
+			connected = true
+			connectedCh = nil
+			timer = nil
+		case <-timer:
+			log.Warnf("Could not connect to '%v' within %v\n", session.RemoteID, timeout)
+			m.remove(session)
+			session.close()
+			return false
+		case <-session.done:
+			if current, ok := m.Session(session.RemoteID); ok && current != session {
+				session = current
+				connectedCh = session.connected
+				if connected {
+					connectedCh = nil
+				}
+				continue
+			}
+			return connected
+		}
+	}
+}
+
+func (m *PeerManager) handleReject(remoteID string, reason string) error {
+	session, ok := m.Session(remoteID)
+	if !ok || session.PeerConnection.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		return fmt.Errorf("unexpected rejection from '%v': %v", remoteID, reason)
+	}
+	m.remove(session)
+	session.close()
+	return fmt.Errorf("'%v' rejected our offer: %v", remoteID, reason)
+}
@@ -0,0 +1,81 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	p2p "github.com/gurupras/dhwani_backend_p2p"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// relay delivers signals to a PeerManager in order, as if they came from "from"
+func relay(t *testing.T, from string, to func() *PeerManager) Signaler {
+	queue := make(chan p2p.SignalPacket, 100)
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+	})
+	go func() {
+		for {
+			select {
+			case sp := <-queue:
+				sp.From = from
+				to().HandleSignal(sp)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return funcSignaler(func(sp p2p.SignalPacket) {
+		queue <- sp
+	})
+}
+
+func TestCall(t *testing.T) {
+	require := require.New(t)
+
+	var caller, studio *PeerManager
+	decisions := make(chan string, 10)
+	attempts := 0
+	studio = NewPeerManager(relay(t, "studio", func() *PeerManager { return caller }), Config{
+		Admit: func(req AdmissionRequest, decide func(err error)) {
+			decisions <- req.PIN
+			attempts++
+			if attempts == 1 {
+				decide(fmt.Errorf("busy"))
+				return
+			}
+			decide(nil)
+		},
+	})
+	defer studio.CloseAll()
+	caller = NewPeerManager(relay(t, "caller", func() *PeerManager { return studio }), Config{
+		Tracks: func(remoteID string) []webrtc.TrackLocal {
+			return []webrtc.TrackLocal{newTestTrack(t)}
+		},
+	})
+	defer caller.CloseAll()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		caller.Call(ctx, "studio", CallOptions{PIN: "1234", MinBackoff: 10 * time.Millisecond, ConnectTimeout: 10 * time.Second})
+		close(stopped)
+	}()
+
+	// The first offer is rejected and the second one gets through
+	require.Equal("1234", <-decisions)
+	require.Equal("1234", <-decisions)
+	require.Eventually(func() bool {
+		session, ok := caller.Session("studio")
+		return ok && session.PeerConnection.ConnectionState() == webrtc.PeerConnectionStateConnected
+	}, 10*time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-stopped
+	_, ok := caller.Session("studio")
+	require.False(ok)
+}
@@ -0,0 +1,88 @@
+package peer
+
+import (
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+// MimeTypeL16 is uncompressed 16 bit big-endian PCM
+const MimeTypeL16 = "audio/L16"
+
+// l16PayloadType is a dynamic payload type pion does not use by default
+const l16PayloadType = 110
+
+// staticPayloadTypes are the audio codecs offers may use without an rtpmap (RFC 3551)
+var staticPayloadTypes = map[string]string{
+	"0": webrtc.MimeTypePCMU,
+	"8": webrtc.MimeTypePCMA,
+	"9": webrtc.MimeTypeG722,
+}
+
+// NewAPI returns a WebRTC API with the default codecs, L16, the audio codecs
+// in extra and the default interceptors. It also stamps outgoing packets with
+// transport-wide sequence numbers so that peers send us TWCC feedback
+func NewAPI(extra ...webrtc.RTPCodecParameters) (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	// Uncompressed audio for LAN links is not among pion's defaults
+	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: MimeTypeL16, ClockRate: 48000, Channels: 2},
+		PayloadType:        l16PayloadType,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+	for _, codec := range extra {
+		if err := mediaEngine.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, err
+		}
+	}
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(registry)), nil
+}
+
+// offeredCodecs returns the MIME types of the audio codecs in sdp, most preferred first
+func offeredCodecs(sdp string) []string {
+	payloadTypes := make([]string, 0)
+	names := make(map[string]string)
+	audio := false
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			fields := strings.Fields(line)
+			audio = len(fields) > 3 && fields[0] == "m=audio"
+			if audio {
+				payloadTypes = append(payloadTypes, fields[3:]...)
+			}
+		case audio && strings.HasPrefix(line, "a=rtpmap:"):
+			fields := strings.Fields(strings.TrimPrefix(line, "a=rtpmap:"))
+			if len(fields) == 2 {
+				names[fields[0]] = "audio/" + strings.SplitN(fields[1], "/", 2)[0]
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	codecs := make([]string, 0, len(payloadTypes))
+	for _, payloadType := range payloadTypes {
+		name, ok := names[payloadType]
+		if !ok {
+			name, ok = staticPayloadTypes[payloadType]
+		}
+		if !ok || seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		codecs = append(codecs, name)
+	}
+	return codecs
+}
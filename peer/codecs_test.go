@@ -0,0 +1,69 @@
+package peer
+
+import (
+	"testing"
+
+	p2p "github.com/gurupras/dhwani_backend_p2p"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOfferedCodecs(t *testing.T) {
+	require := require.New(t)
+
+	sdp := "v=0\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 110 0 8 111\r\n" +
+		"a=rtpmap:110 L16/48000/2\r\n" +
+		"a=rtpmap:111 opus/48000/2\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+		"a=rtpmap:96 VP8/90000\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+		"a=rtpmap:111 opus/48000/2\r\n"
+	require.Equal([]string{"audio/L16", webrtc.MimeTypePCMU, webrtc.MimeTypePCMA, "audio/opus"}, offeredCodecs(sdp))
+	require.Empty(offeredCodecs(""))
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	require := require.New(t)
+
+	// A listener that only speaks G.711
+	mediaEngine := &webrtc.MediaEngine{}
+	require.Nil(mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000},
+		PayloadType:        0,
+	}, webrtc.RTPCodecTypeAudio))
+	offerer, err := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine)).NewPeerConnection(webrtc.Configuration{})
+	require.Nil(err)
+	defer offerer.Close()
+	_, err = offerer.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	require.Nil(err)
+
+	api, err := NewAPI()
+	require.Nil(err)
+	var offered []string
+	toOfferer := make(chan p2p.SignalPacket, 100)
+	m := NewPeerManager(funcSignaler(func(sp p2p.SignalPacket) {
+		toOfferer <- sp
+	}), Config{
+		API: api,
+		OnRemoteCodecs: func(remoteID string, codecs []string) {
+			offered = codecs
+		},
+		Tracks: func(remoteID string) []webrtc.TrackLocal {
+			codec := webrtc.RTPCodecCapability{MimeType: offered[0], ClockRate: 8000}
+			track, err := webrtc.NewTrackLocalStaticSample(codec, "audio", "test")
+			require.Nil(err)
+			return []webrtc.TrackLocal{track}
+		},
+	})
+	defer m.CloseAll()
+
+	require.Nil(m.HandleSignal(offerPacket(t, offerer, "listener")))
+	require.Equal([]string{webrtc.MimeTypePCMU}, offered)
+	answer := <-toOfferer
+	require.Equal(SignalAnswer, answer.Type)
+	desc, err := decodeDescription(answer.Data)
+	require.Nil(err)
+	require.Equal([]string{webrtc.MimeTypePCMU}, offeredCodecs(desc.SDP))
+	require.Nil(offerer.SetRemoteDescription(desc))
+}
@@ -0,0 +1,125 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// RejectedError is returned by Answer when the admission policy refuses a peer
+type RejectedError struct {
+	Reason error
+}
+
+func (e *RejectedError) Error() string {
+	return e.Reason.Error()
+}
+
+func (e *RejectedError) Unwrap() error {
+	return e.Reason
+}
+
+// Answer admits the peer in req and answers its offer directly rather than
+// over the signaling server, e.g. for WHEP and WHIP. The answer carries every
+// candidate, so the peer need not trickle. Peers that only send are not sent
+// our tracks. Sessions created this way are never renegotiated.
+func (m *PeerManager) Answer(ctx context.Context, req AdmissionRequest, offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	if err := m.admitDirect(ctx, req); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	sendOnly := sendsOnly(offer.SDP)
+	if m.config.OnRemoteCodecs != nil && !sendOnly {
+		m.config.OnRemoteCodecs(req.RemoteID, offeredCodecs(offer.SDP))
+	}
+	session, err := m.newSession(req.RemoteID, sessionOptions{direct: true, sendOnly: sendOnly, capped: true})
+	if errors.Is(err, ErrTooManySessions) {
+		return webrtc.SessionDescription{}, &RejectedError{Reason: err}
+	}
+	if err != nil {
+		return webrtc.SessionDescription{}, fmt.Errorf("failed to create session with '%v': %w", req.RemoteID, err)
+	}
+	pc := session.PeerConnection
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if _, err := m.createAnswer(session, offer); err != nil {
+		m.remove(session)
+		session.close()
+		return webrtc.SessionDescription{}, fmt.Errorf("failed to answer '%v': %w", req.RemoteID, err)
+	}
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		m.remove(session)
+		session.close()
+		return webrtc.SessionDescription{}, ctx.Err()
+	}
+	local := pc.LocalDescription()
+	if local == nil {
+		return webrtc.SessionDescription{}, fmt.Errorf("session with '%v' closed while gathering candidates", req.RemoteID)
+	}
+	answer := *local
+	answer.SDP = m.mungeAnswer(pc, answer.SDP)
+	return answer, nil
+}
+
+// admitDirect runs req through the admission policy, waiting for its decision until ctx is done
+func (m *PeerManager) admitDirect(ctx context.Context, req AdmissionRequest) error {
+	if err := m.checkCapacity(req.RemoteID); err != nil {
+		return &RejectedError{Reason: err}
+	}
+	if m.config.Admit == nil {
+		return nil
+	}
+	decided := make(chan error, 1)
+	req.Done = ctx.Done()
+	m.config.Admit(req, func(err error) {
+		decided <- err
+	})
+	select {
+	case err := <-decided:
+		if err != nil {
+			return &RejectedError{Reason: err}
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	// Others may have connected while we waited
+	if err := m.checkCapacity(req.RemoteID); err != nil {
+		return &RejectedError{Reason: err}
+	}
+	return nil
+}
+
+// AddCandidate adds a candidate trickled by the peer of a session created by Answer
+func (m *PeerManager) AddCandidate(remoteID string, candidate webrtc.ICECandidateInit) error {
+	session, ok := m.Session(remoteID)
+	if !ok {
+		return fmt.Errorf("no session with '%v'", remoteID)
+	}
+	if err := session.addRemoteCandidate(candidate); err != nil {
+		return fmt.Errorf("failed to add candidate from '%v': %w", remoteID, err)
+	}
+	return nil
+}
+
+// sendsOnly reports whether every audio section of sdp is sendonly
+func sendsOnly(sdp string) bool {
+	sections := 0
+	sending := 0
+	audio := false
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			audio = strings.HasPrefix(line, "m=audio ")
+			if audio {
+				sections++
+			}
+		case audio && line == "a=sendonly":
+			sending++
+		}
+	}
+	return sections > 0 && sending == sections
+}
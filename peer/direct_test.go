@@ -0,0 +1,155 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	p2p "github.com/gurupras/dhwani_backend_p2p"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnswer(t *testing.T) {
+	require := require.New(t)
+
+	track := newTestTrack(t)
+	closed := make(chan string, 1)
+	m := NewPeerManager(funcSignaler(func(sp p2p.SignalPacket) {
+		t.Errorf("direct session sent %v", sp.Type)
+	}), Config{
+		Tracks: func(remoteID string) []webrtc.TrackLocal {
+			return []webrtc.TrackLocal{track}
+		},
+		OnClose: func(remoteID string) {
+			closed <- remoteID
+		},
+	})
+	defer m.CloseAll()
+
+	offerer := newOfferer(t)
+	connected := make(chan struct{})
+	offerer.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+	offer, err := offerer.CreateOffer(nil)
+	require.Nil(err)
+	require.Nil(offerer.SetLocalDescription(offer))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	answer, err := m.Answer(ctx, AdmissionRequest{RemoteID: "whep-1"}, offer)
+	require.Nil(err)
+	require.Contains(answer.SDP, "a=candidate:")
+	require.Nil(offerer.SetRemoteDescription(answer))
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		require.Fail("timed out waiting to connect")
+	}
+	session, ok := m.Session("whep-1")
+	require.True(ok)
+	require.Len(session.PeerConnection.GetSenders(), 1)
+	require.Nil(m.AddTrack(newTestTrack(t)))
+	require.Nil(m.SetTracks("whep-1", nil))
+	require.Len(session.PeerConnection.GetSenders(), 2)
+	require.NotNil(m.AddCandidate("whep-2", webrtc.ICECandidateInit{Candidate: "candidate:1 1 udp 1 127.0.0.1 9 typ host"}))
+
+	require.Nil(m.Close("whep-1"))
+	require.Equal("whep-1", <-closed)
+
+	// Encoders that only send are not sent our tracks
+	sending, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.Nil(err)
+	defer sending.Close()
+	_, err = sending.AddTransceiverFromTrack(newTestTrack(t), webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	require.Nil(err)
+	offer, err = sending.CreateOffer(nil)
+	require.Nil(err)
+	require.True(sendsOnly(offer.SDP))
+	_, err = m.Answer(ctx, AdmissionRequest{RemoteID: "whip-1"}, offer)
+	require.Nil(err)
+	session, ok = m.Session("whip-1")
+	require.True(ok)
+	for _, sender := range session.PeerConnection.GetSenders() {
+		require.Nil(sender.Track())
+	}
+}
+
+func TestAnswerRejected(t *testing.T) {
+	require := require.New(t)
+
+	refused := errors.New("wrong PIN")
+	m := NewPeerManager(funcSignaler(func(sp p2p.SignalPacket) {}), Config{
+		Admit: func(req AdmissionRequest, decide func(err error)) {
+			if req.PIN == "1234" {
+				decide(nil)
+				return
+			}
+			decide(refused)
+		},
+	})
+	defer m.CloseAll()
+
+	offer, err := newOfferer(t).CreateOffer(nil)
+	require.Nil(err)
+	_, err = m.Answer(context.Background(), AdmissionRequest{RemoteID: "whep-1", PIN: "0000"}, offer)
+	rejected := &RejectedError{}
+	require.True(errors.As(err, &rejected))
+	require.True(errors.Is(err, refused))
+	_, ok := m.Session("whep-1")
+	require.False(ok)
+
+	// An admission that never decides gives up with ctx
+	m.config.Admit = func(req AdmissionRequest, decide func(err error)) {}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = m.Answer(ctx, AdmissionRequest{RemoteID: "whep-1"}, offer)
+	require.True(errors.Is(err, context.DeadlineExceeded))
+	require.False(strings.Contains(err.Error(), "wrong PIN"))
+}
+
+func TestAnswerCapacity(t *testing.T) {
+	require := require.New(t)
+
+	// Approval releases every waiting offer at once
+	approved := make(chan struct{})
+	m := NewPeerManager(funcSignaler(func(sp p2p.SignalPacket) {}), Config{
+		MaxSessions: 1,
+		Admit: func(req AdmissionRequest, decide func(err error)) {
+			go func() {
+				<-approved
+				decide(nil)
+			}()
+		},
+	})
+	defer m.CloseAll()
+
+	const offers = 4
+	results := make(chan error, offers)
+	for i := 0; i < offers; i++ {
+		offer, err := newOfferer(t).CreateOffer(nil)
+		require.Nil(err)
+		go func(i int) {
+			_, err := m.Answer(context.Background(), AdmissionRequest{RemoteID: fmt.Sprintf("whep-%v", i)}, offer)
+			results <- err
+		}(i)
+	}
+	close(approved)
+	admitted := 0
+	for i := 0; i < offers; i++ {
+		err := <-results
+		if err == nil {
+			admitted++
+			continue
+		}
+		require.True(errors.Is(err, ErrTooManySessions))
+	}
+	require.Equal(1, admitted)
+	require.Len(m.Sessions(), 1)
+}
@@ -0,0 +1,136 @@
+package peer
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// fmtpParameters are the format parameters our tracks dictate in our
+// descriptions. pion answers with the offerer's parameters, which say nothing
+// about what we send (e.g. stereo=1)
+var fmtpParameters = map[string][]string{
+	"audio/opus":      {"stereo", "sprop-stereo"},
+	"audio/multiopus": {"channel_mapping", "num_streams", "coupled_streams"},
+}
+
+// codecTrack is implemented by pion's static tracks
+type codecTrack interface {
+	Codec() webrtc.RTPCodecCapability
+}
+
+// applyTrackFmtp sets the fmtp attributes of description, a description of
+// pc, to the format parameters of the tracks pc sends
+func applyTrackFmtp(pc *webrtc.PeerConnection, description string) string {
+	codecs := make(map[string]webrtc.RTPCodecCapability)
+	for _, transceiver := range pc.GetTransceivers() {
+		sender := transceiver.Sender()
+		if sender == nil || transceiver.Mid() == "" {
+			continue
+		}
+		if track, ok := sender.Track().(codecTrack); ok {
+			if _, ok := fmtpParameters[strings.ToLower(track.Codec().MimeType)]; ok {
+				codecs[transceiver.Mid()] = track.Codec()
+			}
+		}
+	}
+	if len(codecs) == 0 {
+		return description
+	}
+
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(description)); err != nil {
+		log.Warnf("Failed to parse our own description: %v\n", err)
+		return description
+	}
+	for _, media := range parsed.MediaDescriptions {
+		mid, _ := media.Attribute("mid")
+		if codec, ok := codecs[mid]; ok {
+			setFmtp(media, codec)
+		}
+	}
+	b, err := parsed.Marshal()
+	if err != nil {
+		log.Warnf("Failed to marshal our own description: %v\n", err)
+		return description
+	}
+	return string(b)
+}
+
+// setFmtp sets the parameters codec dictates on the fmtp attribute of the
+// payload type media uses for codec, adding the attribute if needed
+func setFmtp(media *sdp.MediaDescription, codec webrtc.RTPCodecCapability) {
+	wanted := sdp.Codec{Name: strings.TrimPrefix(strings.ToLower(codec.MimeType), "audio/")}
+	// Every multiopus layout has its own payload type. Opus is always /2
+	if codec.Channels > 2 {
+		wanted.EncodingParameters = strconv.Itoa(int(codec.Channels))
+	}
+	// Payload types are looked up in media alone, since sections may differ
+	section := &sdp.SessionDescription{MediaDescriptions: []*sdp.MediaDescription{media}}
+	payloadType, err := section.GetPayloadTypeForCodec(wanted)
+	if err != nil {
+		return
+	}
+
+	keys := fmtpParameters[strings.ToLower(codec.MimeType)]
+	prefix := strconv.Itoa(int(payloadType)) + " "
+	rtpmap := -1
+	for i, attribute := range media.Attributes {
+		switch {
+		case attribute.Key == "rtpmap" && strings.HasPrefix(attribute.Value, prefix):
+			rtpmap = i
+		case attribute.Key == "fmtp" && strings.HasPrefix(attribute.Value, prefix):
+			values := fmtpValues(strings.TrimPrefix(attribute.Value, prefix))
+			media.Attributes[i].Value = prefix + formatFmtp(values, fmtpValues(codec.SDPFmtpLine), keys)
+			return
+		}
+	}
+	fmtp := sdp.NewAttribute("fmtp", prefix+formatFmtp(nil, fmtpValues(codec.SDPFmtpLine), keys))
+	media.Attributes = append(media.Attributes[:rtpmap+1], append([]sdp.Attribute{fmtp}, media.Attributes[rtpmap+1:]...)...)
+}
+
+// fmtpParameter is one key=value of an fmtp line
+type fmtpParameter struct {
+	key, value string
+}
+
+func fmtpValues(line string) []fmtpParameter {
+	values := make([]fmtpParameter, 0)
+	for _, parameter := range strings.Split(line, ";") {
+		parameter = strings.TrimSpace(parameter)
+		if parameter == "" {
+			continue
+		}
+		pair := strings.SplitN(parameter, "=", 2)
+		value := ""
+		if len(pair) == 2 {
+			value = pair[1]
+		}
+		values = append(values, fmtpParameter{key: pair[0], value: value})
+	}
+	return values
+}
+
+// formatFmtp keeps the values of the existing parameters, except for keys,
+// which take their values from wanted
+func formatFmtp(values, wanted []fmtpParameter, keys []string) string {
+	owned := make(map[string]bool)
+	for _, key := range keys {
+		owned[key] = true
+	}
+	parameters := make([]string, 0, len(values)+len(wanted))
+	for _, parameter := range values {
+		if !owned[parameter.key] {
+			parameters = append(parameters, parameter.key+"="+parameter.value)
+		}
+	}
+	for _, parameter := range wanted {
+		if owned[parameter.key] {
+			parameters = append(parameters, parameter.key+"="+parameter.value)
+		}
+	}
+	return strings.Join(parameters, ";")
+}
@@ -0,0 +1,81 @@
+package peer
+
+import (
+	"strings"
+	"testing"
+
+	p2p "github.com/gurupras/dhwani_backend_p2p"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetFmtp(t *testing.T) {
+	require := require.New(t)
+
+	newMedia := func() *sdp.MediaDescription {
+		return (&sdp.MediaDescription{}).
+			WithCodec(111, "opus", 48000, 2, "minptime=10;stereo=0;useinbandfec=1").
+			WithCodec(112, "multiopus", 48000, 6, "")
+	}
+	media := newMedia()
+	stereo := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, SDPFmtpLine: "minptime=20;stereo=1;sprop-stereo=1"}
+	setFmtp(media, stereo)
+	require.Equal([]sdp.Attribute{
+		sdp.NewAttribute("rtpmap", "111 opus/48000/2"),
+		sdp.NewAttribute("fmtp", "111 minptime=10;useinbandfec=1;stereo=1;sprop-stereo=1"),
+		sdp.NewAttribute("rtpmap", "112 multiopus/48000/6"),
+	}, media.Attributes)
+
+	media = newMedia()
+	surround := webrtc.RTPCodecCapability{MimeType: "audio/multiopus", Channels: 6, SDPFmtpLine: "channel_mapping=0,4,1,2,3,5;num_streams=4;coupled_streams=2;minptime=10"}
+	setFmtp(media, surround)
+	require.Equal([]sdp.Attribute{
+		sdp.NewAttribute("rtpmap", "111 opus/48000/2"),
+		sdp.NewAttribute("fmtp", "111 minptime=10;stereo=0;useinbandfec=1"),
+		sdp.NewAttribute("rtpmap", "112 multiopus/48000/6"),
+		sdp.NewAttribute("fmtp", "112 channel_mapping=0,4,1,2,3,5;num_streams=4;coupled_streams=2"),
+	}, media.Attributes)
+
+	media = newMedia()
+	setFmtp(media, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU})
+	require.Equal(newMedia(), media)
+
+	// Each multiopus layout has its own payload type
+	media = (&sdp.MediaDescription{}).
+		WithCodec(104, "multiopus", 48000, 4, "").
+		WithCodec(113, "multiopus", 48000, 8, "")
+	surround = webrtc.RTPCodecCapability{MimeType: "audio/multiopus", Channels: 8, SDPFmtpLine: "channel_mapping=0,6,1,2,3,4,5,7;num_streams=5;coupled_streams=3"}
+	setFmtp(media, surround)
+	require.Equal([]sdp.Attribute{
+		sdp.NewAttribute("rtpmap", "104 multiopus/48000/4"),
+		sdp.NewAttribute("rtpmap", "113 multiopus/48000/8"),
+		sdp.NewAttribute("fmtp", "113 channel_mapping=0,6,1,2,3,4,5,7;num_streams=5;coupled_streams=3"),
+	}, media.Attributes)
+}
+
+func TestStereoAnswer(t *testing.T) {
+	require := require.New(t)
+
+	offerer := newOfferer(t)
+	toOfferer := make(chan p2p.SignalPacket, 100)
+	m := NewPeerManager(funcSignaler(func(sp p2p.SignalPacket) {
+		toOfferer <- sp
+	}), Config{
+		Tracks: func(remoteID string) []webrtc.TrackLocal {
+			codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1;stereo=1;sprop-stereo=1"}
+			track, err := webrtc.NewTrackLocalStaticSample(codec, "audio", "test")
+			require.Nil(err)
+			return []webrtc.TrackLocal{track}
+		},
+	})
+	defer m.CloseAll()
+
+	require.Nil(m.HandleSignal(offerPacket(t, offerer, "listener")))
+	answer := <-toOfferer
+	require.Equal(SignalAnswer, answer.Type)
+	desc, err := decodeDescription(answer.Data)
+	require.Nil(err)
+	require.True(strings.Contains(desc.SDP, "stereo=1;sprop-stereo=1"), desc.SDP)
+	require.Nil(offerer.SetRemoteDescription(desc))
+}
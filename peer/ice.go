@@ -0,0 +1,102 @@
+package peer
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// DefaultTURNTTL is how long generated TURN credentials remain valid
+const DefaultTURNTTL = 24 * time.Hour
+
+// ICEServer describes a STUN or TURN server. A TURN server either has static
+// credentials or a Secret shared with it, from which time-limited credentials
+// are generated using the TURN REST API scheme.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+	// Secret is the TURN server's static-auth-secret
+	Secret string `json:"secret,omitempty"`
+	// TTL of generated credentials. Defaults to DefaultTURNTTL
+	TTL Duration `json:"ttl,omitempty"`
+}
+
+// Duration is a time.Duration that is written as a string such as "12h" in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// TURNCredentials returns a username and credential that expire ttl after now.
+// The username is "expiry:user" and the credential is the base64 HMAC-SHA1 of
+// the username keyed with secret.
+func TURNCredentials(secret, user string, ttl time.Duration, now time.Time) (string, string) {
+	username := strconv.FormatInt(now.Add(ttl).Unix(), 10)
+	if user != "" {
+		username += ":" + user
+	}
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// WebRTC returns the server as used by a PeerConnection created at now
+func (s ICEServer) WebRTC(now time.Time) webrtc.ICEServer {
+	server := webrtc.ICEServer{
+		URLs:     s.URLs,
+		Username: s.Username,
+	}
+	if s.Secret != "" {
+		ttl := time.Duration(s.TTL)
+		if ttl <= 0 {
+			ttl = DefaultTURNTTL
+		}
+		server.Username, server.Credential = TURNCredentials(s.Secret, s.Username, ttl, now)
+	} else if s.Credential != "" {
+		server.Credential = s.Credential
+	}
+	if server.Credential != nil {
+		server.CredentialType = webrtc.ICECredentialTypePassword
+	}
+	return server
+}
+
+// LoadICEServers reads a JSON array of ICEServer from path
+func LoadICEServers(path string) ([]ICEServer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var servers []ICEServer
+	if err := json.Unmarshal(b, &servers); err != nil {
+		return nil, fmt.Errorf("failed to parse ICE servers in '%v': %w", path, err)
+	}
+	for idx, server := range servers {
+		if len(server.URLs) == 0 {
+			return nil, fmt.Errorf("ICE server %v in '%v' has no urls", idx, path)
+		}
+	}
+	return servers, nil
+}
@@ -0,0 +1,54 @@
+package peer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTURNCredentials(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Unix(1700000000, 0)
+	username, credential := TURNCredentials("north", "alice", time.Hour, now)
+	require.Equal("1700003600:alice", username)
+	require.Equal("wjwSXO2ch1B6VaLTLMy2Avn5O9o=", credential)
+
+	username, _ = TURNCredentials("north", "", time.Hour, now)
+	require.Equal("1700003600", username)
+
+	server := ICEServer{URLs: []string{"turn:example.com:3478"}, Username: "alice", Secret: "north", TTL: Duration(time.Hour)}.WebRTC(now)
+	require.Equal("1700003600:alice", server.Username)
+	require.Equal("wjwSXO2ch1B6VaLTLMy2Avn5O9o=", server.Credential)
+	require.Equal(webrtc.ICECredentialTypePassword, server.CredentialType)
+
+	stun := ICEServer{URLs: []string{"stun:example.com:3478"}}.WebRTC(now)
+	require.Nil(stun.Credential)
+}
+
+func TestLoadICEServers(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "ice.json")
+	require.Nil(os.WriteFile(path, []byte(`[
+		{"urls": ["stun:example.com:3478"]},
+		{"urls": ["turn:example.com:3478?transport=udp"], "username": "dhwani", "secret": "north", "ttl": "12h"}
+	]`), 0600))
+	servers, err := LoadICEServers(path)
+	require.Nil(err)
+	require.Len(servers, 2)
+	require.Equal(Duration(12*time.Hour), servers[1].TTL)
+
+	require.Nil(os.WriteFile(path, []byte(`[{"username": "dhwani"}]`), 0600))
+	_, err = LoadICEServers(path)
+	require.NotNil(err)
+
+	m := NewPeerManager(nil, Config{ICEServers: servers})
+	configuration := m.configuration()
+	require.Len(configuration.ICEServers, 2)
+	require.Contains(configuration.ICEServers[1].Username, ":dhwani")
+}
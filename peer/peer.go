@@ -0,0 +1,631 @@
+// Package peer manages the WebRTC sessions this peer has with remote peers,
+// driven by signals relayed through the signaling server.
+package peer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	p2p "github.com/gurupras/dhwani_backend_p2p"
+	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Signaler delivers signal packets to remote peers. *p2p.ServerConn implements it.
+type Signaler interface {
+	SendSignal(ctx context.Context, sp p2p.SignalPacket) error
+}
+
+// Config describes how sessions are set up
+type Config struct {
+	// WebRTC is used for every new PeerConnection
+	WebRTC webrtc.Configuration
+	// API, if set, creates the PeerConnections. See NewAPI
+	API *webrtc.API
+	// ICEServers, if set, replace WebRTC.ICEServers. They are resolved for every
+	// session so that generated TURN credentials are always fresh
+	ICEServers []ICEServer
+	// Tracks returns the local tracks sent to a new session with remoteID
+	Tracks func(remoteID string) []webrtc.TrackLocal
+	// MungeAnswer, if set, may rewrite the SDP of our answers
+	MungeAnswer func(sdp string) string
+	// OnDataChannel, if set, is called for data channels the remote peer opens
+	OnDataChannel func(remoteID string, dc *webrtc.DataChannel)
+	// OnRemoteCodecs, if set, is told the audio codecs in the offer of a peer
+	// without a session, most preferred first, before Tracks is asked for its tracks
+	OnRemoteCodecs func(remoteID string, codecs []string)
+	// OnTrack, if set, is called for every track the remote peer sends us
+	OnTrack func(remoteID string, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver)
+	// Bitrate bounds the estimated bitrate of each session. Estimation needs a Ceiling
+	Bitrate BitrateConfig
+	// OnBitrate, if set, is called when the estimated bitrate of a session changes
+	OnBitrate func(remoteID string, bps int)
+	// Admit, if set, decides whether peers without a session may connect
+	Admit Admit
+	// MaxSessions, if set, caps the number of concurrent sessions
+	MaxSessions int
+	// OnClose, if set, is called once a session has closed, unless a newer
+	// session with the same peer replaced it
+	OnClose func(remoteID string)
+}
+
+const (
+	outboxSize = 64
+	// maxEarlyCandidates bounds the candidates held for a peer we have no session with yet
+	maxEarlyCandidates = 32
+	// maxEarlyPeers bounds the peers we hold candidates for
+	maxEarlyPeers = 64
+	// earlyTimeout is how long we hold candidates for an offer that never arrives
+	earlyTimeout = 30 * time.Second
+)
+
+// Session is a WebRTC session with one remote peer
+type Session struct {
+	RemoteID       string
+	PeerConnection *webrtc.PeerConnection
+
+	mutex sync.Mutex
+	// remoteCandidates arrived before the remote description was applied
+	remoteCandidates []webrtc.ICECandidateInit
+	// localCandidates were gathered before our description was signaled
+	localCandidates []webrtc.ICECandidateInit
+	localSignaled   bool
+	// pendingNegotiation is set when tracks changed while an offer was outstanding
+	pendingNegotiation bool
+	outbox             chan p2p.SignalPacket
+	done               chan struct{}
+	closing            sync.Once
+	// connected is closed once the session first connects
+	connected  chan struct{}
+	connecting sync.Once
+	// pin is sent in our offers
+	pin string
+	// trackStats holds what the remote peer reported about each of our streams, by SSRC
+	trackStats map[uint32]*TrackStats
+	// estimator is nil unless bitrate estimation is enabled
+	estimator *estimator
+	onBitrate func(bps int)
+	// direct sessions were negotiated over HTTP. They never signal
+	direct  bool
+	onClose func()
+}
+
+// sessionOptions configure newSession
+type sessionOptions struct {
+	direct bool
+	// sendOnly peers are not sent our tracks
+	sendOnly bool
+	// capped sessions count towards Config.MaxSessions
+	capped bool
+}
+
+// close stops the session's signaling and its PeerConnection
+func (s *Session) close() error {
+	first := false
+	s.closing.Do(func() {
+		close(s.done)
+		first = true
+	})
+	err := s.PeerConnection.Close()
+	if first && s.onClose != nil {
+		s.onClose()
+	}
+	return err
+}
+
+// signal queues sp for delivery. Signals to a peer go out in the order they were queued.
+func (s *Session) signal(sp p2p.SignalPacket) {
+	if s.direct {
+		return
+	}
+	select {
+	case <-s.done:
+	case s.outbox <- sp:
+	default:
+		log.Warnf("Signal queue for '%v' is full. Dropped %v\n", s.RemoteID, sp.Type)
+	}
+}
+
+// signalDescription sends our local description followed by every candidate
+// gathered while it was being created
+func (s *Session) signalDescription(sp p2p.SignalPacket) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.signalDescriptionLocked(sp)
+}
+
+func (s *Session) signalDescriptionLocked(sp p2p.SignalPacket) {
+	s.signal(sp)
+	s.localSignaled = true
+	for _, candidate := range s.localCandidates {
+		s.signalCandidateLocked(candidate)
+	}
+	s.localCandidates = nil
+}
+
+func (s *Session) signalCandidate(candidate webrtc.ICECandidateInit) {
+	if s.direct {
+		// Direct sessions put their candidates in the answer
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.localSignaled {
+		// The remote side cannot use candidates before our description
+		s.localCandidates = append(s.localCandidates, candidate)
+		return
+	}
+	s.signalCandidateLocked(candidate)
+}
+
+func (s *Session) signalCandidateLocked(candidate webrtc.ICECandidateInit) {
+	data, err := EncodeJSON(candidateMessage{
+		Type:      SignalCandidate,
+		Candidate: candidate,
+	})
+	if err != nil {
+		log.Errorf("Failed to encode candidate: %v\n", err)
+		return
+	}
+	s.signal(p2p.SignalPacket{To: s.RemoteID, Type: SignalCandidate, Data: data})
+}
+
+// setRemoteDescription applies desc and then any candidates that arrived before it
+func (s *Session) setRemoteDescription(desc webrtc.SessionDescription) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.PeerConnection.SetRemoteDescription(desc); err != nil {
+		return err
+	}
+	for _, candidate := range s.remoteCandidates {
+		if err := s.PeerConnection.AddICECandidate(candidate); err != nil {
+			log.Warnf("Failed to add buffered candidate from '%v': %v\n", s.RemoteID, err)
+		}
+	}
+	s.remoteCandidates = nil
+	return nil
+}
+
+func (s *Session) addRemoteCandidate(candidate webrtc.ICECandidateInit) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.PeerConnection.RemoteDescription() == nil {
+		s.remoteCandidates = append(s.remoteCandidates, candidate)
+		return nil
+	}
+	return s.PeerConnection.AddICECandidate(candidate)
+}
+
+// PeerManager owns the sessions with remote peers, keyed by remote ID
+type PeerManager struct {
+	signaler Signaler
+	config   Config
+	mutex    sync.Mutex
+	sessions map[string]*Session
+	// early holds candidates from peers whose offer has not been handled yet
+	early map[string]*earlyCandidates
+	// admissions counts the offers of each peer awaiting a decision
+	admissions map[string]int
+	// stopped is set by Shutdown
+	stopped bool
+}
+
+func NewPeerManager(signaler Signaler, config Config) *PeerManager {
+	return &PeerManager{
+		signaler:   signaler,
+		config:     config,
+		sessions:   make(map[string]*Session),
+		early:      make(map[string]*earlyCandidates),
+		admissions: make(map[string]int),
+	}
+}
+
+// HandleSignal acts on an offer, answer, candidate, rejection or bye from a
+// remote peer. Other signal types are ignored.
+func (m *PeerManager) HandleSignal(sp p2p.SignalPacket) error {
+	switch sp.Type {
+	case SignalOffer:
+		offer, err := decodeOffer(sp.Data)
+		if err != nil {
+			return fmt.Errorf("bad offer from '%v': %w", sp.From, err)
+		}
+		return m.handleOffer(sp.From, offer.SessionDescription, offer.PIN)
+	case SignalAnswer:
+		answer, err := decodeDescription(sp.Data)
+		if err != nil {
+			return fmt.Errorf("bad answer from '%v': %w", sp.From, err)
+		}
+		return m.handleAnswer(sp.From, answer)
+	case SignalCandidate:
+		candidate, err := decodeCandidate(sp.Data)
+		if err != nil {
+			return fmt.Errorf("bad candidate from '%v': %w", sp.From, err)
+		}
+		return m.handleCandidate(sp.From, candidate)
+	case SignalReject:
+		msg := RejectMessage{}
+		if err := DecodeJSON(sp.Data, &msg); err != nil {
+			return fmt.Errorf("bad rejection from '%v': %w", sp.From, err)
+		}
+		return m.handleReject(sp.From, msg.Reason)
+	case SignalBye:
+		if _, ok := m.Session(sp.From); !ok {
+			return nil
+		}
+		log.Infof("'%v' said bye\n", sp.From)
+		return m.Close(sp.From)
+	}
+	return nil
+}
+
+// Session returns the session with remoteID
+func (m *PeerManager) Session(remoteID string) (*Session, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	session, ok := m.sessions[remoteID]
+	return session, ok
+}
+
+// Sessions returns all current sessions
+func (m *PeerManager) Sessions() []*Session {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// Close ends the session with remoteID
+func (m *PeerManager) Close(remoteID string) error {
+	m.mutex.Lock()
+	session, ok := m.sessions[remoteID]
+	delete(m.sessions, remoteID)
+	m.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("no session with '%v'", remoteID)
+	}
+	return session.close()
+}
+
+// CloseAll ends every session
+func (m *PeerManager) CloseAll() {
+	m.mutex.Lock()
+	sessions := m.sessions
+	m.sessions = make(map[string]*Session)
+	m.clearEarlyLocked()
+	m.mutex.Unlock()
+	for id, session := range sessions {
+		if err := session.close(); err != nil {
+			log.Warnf("Failed to close session with '%v': %v\n", id, err)
+		}
+	}
+}
+
+// Shutdown says bye to every peer and closes every session. It gives up on
+// saying bye once ctx is done. No new sessions are created afterwards.
+func (m *PeerManager) Shutdown(ctx context.Context) error {
+	m.mutex.Lock()
+	m.stopped = true
+	sessions := m.sessions
+	m.sessions = make(map[string]*Session)
+	m.clearEarlyLocked()
+	m.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, session := range sessions {
+		wg.Add(1)
+		go func(session *Session) {
+			defer wg.Done()
+			// HTTP peers notice the session closing instead
+			if !session.direct {
+				bye := p2p.SignalPacket{To: session.RemoteID, Type: SignalBye}
+				if err := m.signaler.SendSignal(ctx, bye); err != nil {
+					log.Warnf("Failed to say bye to '%v': %v\n", session.RemoteID, err)
+				}
+			}
+			if err := session.close(); err != nil {
+				log.Warnf("Failed to close session with '%v': %v\n", session.RemoteID, err)
+			}
+		}(session)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// remove forgets session if it is still the current session with its peer
+func (m *PeerManager) remove(session *Session) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.sessions[session.RemoteID] == session {
+		delete(m.sessions, session.RemoteID)
+		log.Debugf("Removed session with '%v'\n", session.RemoteID)
+	}
+}
+
+// newSession creates a PeerConnection for remoteID, replacing any previous session with it
+func (m *PeerManager) newSession(remoteID string, options sessionOptions) (*Session, error) {
+	var pc *webrtc.PeerConnection
+	var err error
+	if m.config.API != nil {
+		pc, err = m.config.API.NewPeerConnection(m.configuration())
+	} else {
+		pc, err = webrtc.NewPeerConnection(m.configuration())
+	}
+	if err != nil {
+		return nil, err
+	}
+	session := &Session{
+		RemoteID:       remoteID,
+		PeerConnection: pc,
+		outbox:         make(chan p2p.SignalPacket, outboxSize),
+		done:           make(chan struct{}),
+		connected:      make(chan struct{}),
+		trackStats:     make(map[uint32]*TrackStats),
+		direct:         options.direct,
+	}
+	if m.config.OnClose != nil {
+		session.onClose = func() {
+			if _, ok := m.Session(remoteID); !ok {
+				m.config.OnClose(remoteID)
+			}
+		}
+	}
+	if m.config.Bitrate.Ceiling > 0 {
+		session.estimator = newEstimator(m.config.Bitrate)
+		if m.config.OnBitrate != nil {
+			session.onBitrate = func(bps int) {
+				m.config.OnBitrate(remoteID, bps)
+			}
+		}
+	}
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Infof("Connection state with '%v' has changed: %v\n", remoteID, state)
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			session.connecting.Do(func() {
+				close(session.connected)
+			})
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			if state == webrtc.PeerConnectionStateFailed {
+				// What the session looked like before it failed helps explain why
+				logStats(session.Stats())
+			}
+			m.remove(session)
+			if err := session.close(); err != nil {
+				log.Warnf("Failed to close session with '%v': %v\n", remoteID, err)
+			}
+		}
+	})
+
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			log.Debugf("ICE gathering for '%v' complete\n", remoteID)
+			return
+		}
+		session.signalCandidate(c.ToJSON())
+	})
+
+	if m.config.OnDataChannel != nil {
+		pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+			m.config.OnDataChannel(remoteID, dc)
+		})
+	}
+
+	if m.config.OnTrack != nil {
+		pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+			m.config.OnTrack(remoteID, track, receiver)
+		})
+	}
+
+	if m.config.Tracks != nil && !options.sendOnly {
+		for _, track := range m.config.Tracks(remoteID) {
+			rtpSender, err := pc.AddTrack(track)
+			if err != nil {
+				pc.Close()
+				return nil, fmt.Errorf("failed to add track '%v': %w", track.ID(), err)
+			}
+			go session.readRTCP(rtpSender)
+		}
+	}
+
+	m.mutex.Lock()
+	if m.stopped {
+		m.mutex.Unlock()
+		pc.Close()
+		return nil, fmt.Errorf("shutting down")
+	}
+	previous, hadPrevious := m.sessions[remoteID]
+	// Checked under the same lock as the insert, so concurrent offers cannot all pass
+	if options.capped && !hadPrevious && m.config.MaxSessions > 0 && len(m.sessions) >= m.config.MaxSessions {
+		m.mutex.Unlock()
+		pc.Close()
+		return nil, ErrTooManySessions
+	}
+	m.sessions[remoteID] = session
+	session.remoteCandidates = m.takeEarlyLocked(remoteID)
+	m.mutex.Unlock()
+	if hadPrevious {
+		log.Infof("Replacing session with '%v'\n", remoteID)
+		previous.close()
+	}
+	go m.deliver(session)
+	return session, nil
+}
+
+// configuration returns the WebRTC configuration for a new session
+func (m *PeerManager) configuration() webrtc.Configuration {
+	configuration := m.config.WebRTC
+	if len(m.config.ICEServers) == 0 {
+		return configuration
+	}
+	now := time.Now()
+	configuration.ICEServers = make([]webrtc.ICEServer, 0, len(m.config.ICEServers))
+	for _, server := range m.config.ICEServers {
+		configuration.ICEServers = append(configuration.ICEServers, server.WebRTC(now))
+	}
+	return configuration
+}
+
+// deliver sends the session's signals one at a time so that they arrive in order
+func (m *PeerManager) deliver(session *Session) {
+	for {
+		select {
+		case <-session.done:
+			return
+		case sp := <-session.outbox:
+			if err := m.signaler.SendSignal(context.Background(), sp); err != nil {
+				log.Errorf("Failed to send %v to '%v': %v\n", sp.Type, sp.To, err)
+			}
+		}
+	}
+}
+
+func (m *PeerManager) handleOffer(remoteID string, offer webrtc.SessionDescription, pin string) error {
+	if session, ok := m.Session(remoteID); ok && session.sameRemote(offer) {
+		// The remote peer is renegotiating an existing session
+		if err := m.answer(session, offer); err != nil {
+			return fmt.Errorf("failed to renegotiate with '%v': %w", remoteID, err)
+		}
+		return nil
+	}
+	return m.admit(remoteID, offer, pin)
+}
+
+// answer applies offer to session and signals our answer
+func (m *PeerManager) answer(session *Session, offer webrtc.SessionDescription) error {
+	answer, err := m.createAnswer(session, offer)
+	if err != nil {
+		return err
+	}
+	data, err := EncodeJSON(answer)
+	if err != nil {
+		return err
+	}
+	session.signalDescription(p2p.SignalPacket{To: session.RemoteID, Type: SignalAnswer, Data: data})
+	return session.negotiatePending()
+}
+
+// createAnswer applies offer to session and returns our answer as the remote peer should see it
+func (m *PeerManager) createAnswer(session *Session, offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	pc := session.PeerConnection
+	if pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		// Both sides offered at once. We yield and offer again afterwards
+		if err := pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err != nil {
+			return webrtc.SessionDescription{}, fmt.Errorf("failed to roll back our offer: %w", err)
+		}
+		session.mutex.Lock()
+		session.pendingNegotiation = true
+		session.mutex.Unlock()
+	}
+
+	if err := session.setRemoteDescription(offer); err != nil {
+		return webrtc.SessionDescription{}, fmt.Errorf("failed to apply offer: %w", err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return webrtc.SessionDescription{}, fmt.Errorf("failed to create answer: %w", err)
+	}
+	// Starts gathering; candidates trickle out after the answer
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return webrtc.SessionDescription{}, fmt.Errorf("failed to apply answer: %w", err)
+	}
+	answer.SDP = m.mungeAnswer(pc, answer.SDP)
+	return answer, nil
+}
+
+// mungeAnswer rewrites the SDP of an answer before the remote peer sees it
+func (m *PeerManager) mungeAnswer(pc *webrtc.PeerConnection, sdp string) string {
+	sdp = applyTrackFmtp(pc, sdp)
+	if m.config.MungeAnswer != nil {
+		sdp = m.config.MungeAnswer(sdp)
+	}
+	return sdp
+}
+
+func (m *PeerManager) handleAnswer(remoteID string, answer webrtc.SessionDescription) error {
+	session, ok := m.Session(remoteID)
+	if !ok {
+		return fmt.Errorf("unknown peer '%v'. Ignored answer", remoteID)
+	}
+	if err := session.setRemoteDescription(answer); err != nil {
+		return fmt.Errorf("failed to apply answer from '%v': %w", remoteID, err)
+	}
+	if err := session.negotiatePending(); err != nil {
+		return fmt.Errorf("failed to renegotiate with '%v': %w", remoteID, err)
+	}
+	return nil
+}
+
+func (m *PeerManager) handleCandidate(remoteID string, candidate webrtc.ICECandidateInit) error {
+	session, ok := m.Session(remoteID)
+	if !ok {
+		// The offer may still be on its way, unless we could not take it anyway
+		if err := m.checkCapacity(remoteID); err != nil {
+			return fmt.Errorf("ignored candidate from unknown peer '%v': %w", remoteID, err)
+		}
+		return m.holdEarly(remoteID, candidate)
+	}
+	if err := session.addRemoteCandidate(candidate); err != nil {
+		return fmt.Errorf("failed to add candidate from '%v': %w", remoteID, err)
+	}
+	return nil
+}
+
+// earlyCandidates are the candidates of a peer whose offer has not been handled yet
+type earlyCandidates struct {
+	candidates []webrtc.ICECandidateInit
+	// expire drops them if the offer never arrives
+	expire *time.Timer
+}
+
+// holdEarly keeps candidate until the offer of remoteID is handled
+func (m *PeerManager) holdEarly(remoteID string, candidate webrtc.ICECandidateInit) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.stopped {
+		return fmt.Errorf("shutting down")
+	}
+	early, ok := m.early[remoteID]
+	if !ok {
+		if len(m.early) >= maxEarlyPeers {
+			return fmt.Errorf("too many unknown peers. Ignored candidate from '%v'", remoteID)
+		}
+		early = &earlyCandidates{}
+		early.expire = time.AfterFunc(earlyTimeout, func() {
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			if m.early[remoteID] == early {
+				delete(m.early, remoteID)
+			}
+		})
+		m.early[remoteID] = early
+	}
+	if len(early.candidates) >= maxEarlyCandidates {
+		return fmt.Errorf("too many candidates from unknown peer '%v'", remoteID)
+	}
+	early.candidates = append(early.candidates, candidate)
+	return nil
+}
+
+// takeEarlyLocked removes and returns the candidates held for remoteID
+func (m *PeerManager) takeEarlyLocked(remoteID string) []webrtc.ICECandidateInit {
+	early, ok := m.early[remoteID]
+	if !ok {
+		return nil
+	}
+	early.expire.Stop()
+	delete(m.early, remoteID)
+	return early.candidates
+}
+
+func (m *PeerManager) clearEarlyLocked() {
+	for _, early := range m.early {
+		early.expire.Stop()
+	}
+	m.early = make(map[string]*earlyCandidates)
+}
@@ -0,0 +1,358 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	p2p "github.com/gurupras/dhwani_backend_p2p"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/require"
+)
+
+type funcSignaler func(sp p2p.SignalPacket)
+
+func (f funcSignaler) SendSignal(ctx context.Context, sp p2p.SignalPacket) error {
+	f(sp)
+	return nil
+}
+
+func newTestTrack(t *testing.T) *webrtc.TrackLocalStaticSample {
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "test")
+	require.Nil(t, err)
+	return track
+}
+
+// newOfferer creates a receive-only PeerConnection playing the remote listener
+func newOfferer(t *testing.T) *webrtc.PeerConnection {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		pc.Close()
+	})
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	require.Nil(t, err)
+	return pc
+}
+
+func offerPacket(t *testing.T, pc *webrtc.PeerConnection, from string) p2p.SignalPacket {
+	offer, err := pc.CreateOffer(nil)
+	require.Nil(t, err)
+	require.Nil(t, pc.SetLocalDescription(offer))
+	data, err := EncodeJSON(offer)
+	require.Nil(t, err)
+	return p2p.SignalPacket{From: from, To: "broadcaster", Type: SignalOffer, Data: data}
+}
+
+// exchange plays the offerer's side of signaling with m until done is closed
+func exchange(t *testing.T, m *PeerManager, offerer *webrtc.PeerConnection, toOfferer <-chan p2p.SignalPacket, done <-chan struct{}) {
+	require := require.New(t)
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case sp := <-toOfferer:
+			require.Equal("listener", sp.To)
+			switch sp.Type {
+			case SignalAnswer:
+				answer, err := decodeDescription(sp.Data)
+				require.Nil(err)
+				require.Nil(offerer.SetRemoteDescription(answer))
+			case SignalOffer:
+				offer, err := decodeDescription(sp.Data)
+				require.Nil(err)
+				require.Nil(offerer.SetRemoteDescription(offer))
+				answer, err := offerer.CreateAnswer(nil)
+				require.Nil(err)
+				require.Nil(offerer.SetLocalDescription(answer))
+				data, err := EncodeJSON(answer)
+				require.Nil(err)
+				require.Nil(m.HandleSignal(p2p.SignalPacket{From: "listener", Type: SignalAnswer, Data: data}))
+			case SignalCandidate:
+				require.NotNil(offerer.RemoteDescription(), "candidate sent before description")
+				candidate, err := decodeCandidate(sp.Data)
+				require.Nil(err)
+				require.Nil(offerer.AddICECandidate(candidate))
+			}
+		case <-done:
+			return
+		case <-timeout:
+			require.Fail("timed out waiting for signaling")
+		}
+	}
+}
+
+func TestHandleOffer(t *testing.T) {
+	require := require.New(t)
+
+	offerer := newOfferer(t)
+	connected := make(chan struct{})
+	offerer.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+
+	api, err := NewAPI()
+	require.Nil(err)
+	toOfferer := make(chan p2p.SignalPacket, 100)
+	m := NewPeerManager(funcSignaler(func(sp p2p.SignalPacket) {
+		toOfferer <- sp
+	}), Config{
+		API: api,
+		Tracks: func(remoteID string) []webrtc.TrackLocal {
+			return []webrtc.TrackLocal{newTestTrack(t)}
+		},
+		Bitrate: BitrateConfig{Floor: 16000, Ceiling: 128000, Initial: 64000},
+	})
+	defer m.CloseAll()
+
+	// Trickle the offerer's candidates ahead of its offer so that they have to be held
+	gathered := webrtc.GatheringCompletePromise(offerer)
+	candidates := make([]webrtc.ICECandidateInit, 0)
+	offerer.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c != nil {
+			candidates = append(candidates, c.ToJSON())
+		}
+	})
+	offer := offerPacket(t, offerer, "listener")
+	<-gathered
+	require.NotEmpty(candidates)
+	for _, candidate := range candidates {
+		data, err := EncodeJSON(candidateMessage{Type: SignalCandidate, Candidate: candidate})
+		require.Nil(err)
+		require.Nil(m.HandleSignal(p2p.SignalPacket{From: "listener", Type: SignalCandidate, Data: data}))
+	}
+	require.Nil(m.HandleSignal(offer))
+
+	exchange(t, m, offerer, toOfferer, connected)
+
+	_, ok := m.Session("listener")
+	require.True(ok)
+	require.Len(m.Sessions(), 1)
+
+	// Our side may notice it is connected a little after the offerer
+	require.Eventually(func() bool {
+		stats := m.Stats()
+		return len(stats) == 1 && stats[0].State == webrtc.PeerConnectionStateConnected && stats[0].BytesSent > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal("listener", m.Stats()[0].RemoteID)
+	require.Equal(64000, m.Stats()[0].Bitrate)
+
+	require.Nil(m.Close("listener"))
+	_, ok = m.Session("listener")
+	require.False(ok)
+	require.NotNil(m.Close("listener"))
+}
+
+func TestRenegotiate(t *testing.T) {
+	require := require.New(t)
+
+	offerer := newOfferer(t)
+	connected := make(chan struct{})
+	offerer.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+
+	first := newTestTrack(t)
+	toOfferer := make(chan p2p.SignalPacket, 100)
+	m := NewPeerManager(funcSignaler(func(sp p2p.SignalPacket) {
+		toOfferer <- sp
+	}), Config{
+		Tracks: func(remoteID string) []webrtc.TrackLocal {
+			return []webrtc.TrackLocal{first}
+		},
+	})
+	defer m.CloseAll()
+
+	require.Nil(m.HandleSignal(offerPacket(t, offerer, "listener")))
+	exchange(t, m, offerer, toOfferer, connected)
+	session, ok := m.Session("listener")
+	require.True(ok)
+
+	// Adding a track offers it to the connected peer
+	second, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "second")
+	require.Nil(err)
+	require.Nil(m.AddTrack(second))
+	stable := make(chan struct{})
+	offerer.OnSignalingStateChange(func(state webrtc.SignalingState) {
+		if state == webrtc.SignalingStateStable {
+			close(stable)
+		}
+	})
+	exchange(t, m, offerer, toOfferer, stable)
+	require.Len(session.PeerConnection.GetSenders(), 2)
+	require.Len(offerer.GetTransceivers(), 2)
+
+	// Replacing a track needs no signaling
+	replacement := newTestTrack(t)
+	require.Nil(m.ReplaceTrack(first, replacement))
+	require.NotNil(findSender(session.PeerConnection, replacement))
+	require.Nil(findSender(session.PeerConnection, first))
+
+	require.Nil(m.RemoveTrack(second))
+	select {
+	case sp := <-toOfferer:
+		require.Equal(SignalOffer, sp.Type)
+	case <-time.After(5 * time.Second):
+		require.Fail("no offer after removing a track")
+	}
+	sameSession, _ := m.Session("listener")
+	require.Equal(session, sameSession)
+}
+
+func TestDataChannel(t *testing.T) {
+	require := require.New(t)
+
+	offerer := newOfferer(t)
+	_, err := offerer.CreateDataChannel("control", nil)
+	require.Nil(err)
+
+	opened := make(chan struct{})
+	var label, openedBy string
+	toOfferer := make(chan p2p.SignalPacket, 100)
+	m := NewPeerManager(funcSignaler(func(sp p2p.SignalPacket) {
+		toOfferer <- sp
+	}), Config{
+		OnDataChannel: func(remoteID string, dc *webrtc.DataChannel) {
+			label, openedBy = dc.Label(), remoteID
+			close(opened)
+		},
+	})
+	defer m.CloseAll()
+
+	require.Nil(m.HandleSignal(offerPacket(t, offerer, "listener")))
+	exchange(t, m, offerer, toOfferer, opened)
+	require.Equal("control", label)
+	require.Equal("listener", openedBy)
+}
+
+func TestHandleBadSignals(t *testing.T) {
+	require := require.New(t)
+
+	m := NewPeerManager(funcSignaler(func(sp p2p.SignalPacket) {}), Config{})
+	require.NotNil(m.HandleSignal(p2p.SignalPacket{From: "a", Type: SignalOffer, Data: "not base64!"}))
+	require.NotNil(m.HandleSignal(p2p.SignalPacket{From: "a", Type: SignalOffer, Data: "e30="}))
+	require.NotNil(m.HandleSignal(p2p.SignalPacket{From: "a", Type: SignalCandidate, Data: "e30="}))
+
+	data, err := EncodeJSON(candidateMessage{Type: SignalCandidate, Candidate: webrtc.ICECandidateInit{Candidate: "candidate:1 1 udp 1 127.0.0.1 9 typ host"}})
+	require.Nil(err)
+	// Candidates from peers without a session are held, up to a limit
+	for i := 0; i < maxEarlyCandidates; i++ {
+		require.Nil(m.HandleSignal(p2p.SignalPacket{From: "unknown", Type: SignalCandidate, Data: data}))
+	}
+	require.NotNil(m.HandleSignal(p2p.SignalPacket{From: "unknown", Type: SignalCandidate, Data: data}))
+	// And for a limited number of peers
+	for i := 1; i < maxEarlyPeers; i++ {
+		require.Nil(m.HandleSignal(p2p.SignalPacket{From: fmt.Sprintf("unknown-%v", i), Type: SignalCandidate, Data: data}))
+	}
+	require.NotNil(m.HandleSignal(p2p.SignalPacket{From: "one-too-many", Type: SignalCandidate, Data: data}))
+	m.CloseAll()
+	require.Empty(m.early)
+
+	require.Nil(m.HandleSignal(p2p.SignalPacket{From: "a", Type: "identify"}))
+	require.Empty(m.Sessions())
+
+	// Nor are they held for peers we would turn away
+	m = NewPeerManager(funcSignaler(func(sp p2p.SignalPacket) {}), Config{MaxSessions: 1})
+	m.sessions["listener"] = &Session{RemoteID: "listener"}
+	require.NotNil(m.HandleSignal(p2p.SignalPacket{From: "unknown", Type: SignalCandidate, Data: data}))
+	require.Empty(m.early)
+}
+
+func TestAdmission(t *testing.T) {
+	require := require.New(t)
+
+	toOfferer := make(chan p2p.SignalPacket, 100)
+	decisions := make(chan func(err error), 10)
+	m := NewPeerManager(funcSignaler(func(sp p2p.SignalPacket) {
+		toOfferer <- sp
+	}), Config{
+		Admit: func(req AdmissionRequest, decide func(err error)) {
+			require.Equal("1234", req.PIN)
+			decisions <- decide
+		},
+		MaxSessions: 1,
+	})
+	defer m.CloseAll()
+
+	withPIN := func(sp p2p.SignalPacket) p2p.SignalPacket {
+		offer, err := decodeOffer(sp.Data)
+		require.Nil(err)
+		offer.PIN = "1234"
+		sp.Data, err = EncodeJSON(offer)
+		require.Nil(err)
+		return sp
+	}
+	expectReject := func(to string) RejectMessage {
+		select {
+		case sp := <-toOfferer:
+			require.Equal(SignalReject, sp.Type)
+			require.Equal(to, sp.To)
+			msg := RejectMessage{}
+			require.Nil(DecodeJSON(sp.Data, &msg))
+			return msg
+		case <-time.After(5 * time.Second):
+			require.Fail("no rejection")
+		}
+		return RejectMessage{}
+	}
+
+	// Nothing is answered until the offer is admitted
+	offerer := newOfferer(t)
+	require.Nil(m.HandleSignal(withPIN(offerPacket(t, offerer, "listener"))))
+	decide := <-decisions
+	require.Empty(m.Sessions())
+	decide(fmt.Errorf("go away"))
+	require.Equal("go away", expectReject("listener").Reason)
+	require.Empty(m.Sessions())
+
+	offerer = newOfferer(t)
+	require.Nil(m.HandleSignal(withPIN(offerPacket(t, offerer, "listener"))))
+	(<-decisions)(nil)
+	connected := make(chan struct{})
+	offerer.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+	exchange(t, m, offerer, toOfferer, connected)
+
+	// The listener cap is checked before asking
+	require.NotNil(m.HandleSignal(withPIN(offerPacket(t, newOfferer(t), "second"))))
+	require.Equal(ErrTooManySessions.Error(), expectReject("second").Reason)
+	require.Len(m.Sessions(), 1)
+}
+
+func TestShutdown(t *testing.T) {
+	require := require.New(t)
+
+	var caller, studio *PeerManager
+	studio = NewPeerManager(relay(t, "studio", func() *PeerManager { return caller }), Config{})
+	caller = NewPeerManager(relay(t, "caller", func() *PeerManager { return studio }), Config{
+		Tracks: func(remoteID string) []webrtc.TrackLocal {
+			return []webrtc.TrackLocal{newTestTrack(t)}
+		},
+	})
+	defer caller.CloseAll()
+
+	_, err := caller.Dial("studio", "")
+	require.Nil(err)
+	require.Eventually(func() bool {
+		return len(studio.Sessions()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.Nil(studio.Shutdown(ctx))
+	require.Empty(studio.Sessions())
+	// The caller hangs up when told bye rather than waiting for ICE to fail
+	require.Eventually(func() bool {
+		return len(caller.Sessions()) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	_, err = studio.Dial("caller", "")
+	require.NotNil(err)
+}
@@ -0,0 +1,206 @@
+package peer
+
+import (
+	"fmt"
+	"strings"
+
+	p2p "github.com/gurupras/dhwani_backend_p2p"
+	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// negotiate offers the session's current tracks to the remote peer. If an
+// offer is already outstanding, a new one is sent once it is answered.
+func (s *Session) negotiate() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.direct {
+		// HTTP peers cannot be sent offers. They keep what they negotiated
+		log.Debugf("Not renegotiating with '%v'\n", s.RemoteID)
+		return nil
+	}
+	pc := s.PeerConnection
+	if pc.SignalingState() != webrtc.SignalingStateStable {
+		s.pendingNegotiation = true
+		return nil
+	}
+	s.pendingNegotiation = false
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create offer: %w", err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("failed to apply offer: %w", err)
+	}
+	offer.SDP = applyTrackFmtp(pc, offer.SDP)
+	data, err := EncodeJSON(offerMessage{SessionDescription: offer, PIN: s.pin})
+	if err != nil {
+		return err
+	}
+	s.signalDescriptionLocked(p2p.SignalPacket{To: s.RemoteID, Type: SignalOffer, Data: data})
+	return nil
+}
+
+// negotiatePending sends an offer if one was deferred
+func (s *Session) negotiatePending() error {
+	s.mutex.Lock()
+	pending := s.pendingNegotiation
+	s.mutex.Unlock()
+	if !pending {
+		return nil
+	}
+	return s.negotiate()
+}
+
+// sameRemote reports whether offer comes from the PeerConnection this session
+// is already connected to, rather than from a new one (e.g. a reloaded page)
+func (s *Session) sameRemote(offer webrtc.SessionDescription) bool {
+	current := s.PeerConnection.RemoteDescription()
+	if current == nil {
+		return false
+	}
+	fingerprint := sdpFingerprint(current.SDP)
+	return fingerprint != "" && fingerprint == sdpFingerprint(offer.SDP)
+}
+
+// sdpFingerprint returns the first DTLS fingerprint in sdp
+func sdpFingerprint(sdp string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "a=fingerprint:") {
+			return strings.TrimPrefix(line, "a=fingerprint:")
+		}
+	}
+	return ""
+}
+
+// AddTrack sends track to every session, renegotiating each of them
+func (m *PeerManager) AddTrack(track webrtc.TrackLocal) error {
+	return m.eachSession(func(session *Session) error {
+		sender, err := session.PeerConnection.AddTrack(track)
+		if err != nil {
+			return fmt.Errorf("failed to add track '%v': %w", track.ID(), err)
+		}
+		go session.readRTCP(sender)
+		return session.negotiate()
+	})
+}
+
+// RemoveTrack stops sending track to every session, renegotiating each of them
+func (m *PeerManager) RemoveTrack(track webrtc.TrackLocal) error {
+	return m.eachSession(func(session *Session) error {
+		sender := findSender(session.PeerConnection, track)
+		if sender == nil {
+			return nil
+		}
+		if err := session.PeerConnection.RemoveTrack(sender); err != nil {
+			return fmt.Errorf("failed to remove track '%v': %w", track.ID(), err)
+		}
+		return session.negotiate()
+	})
+}
+
+// ReplaceTrack swaps old for track in every session without renegotiating.
+// Both tracks must use the same codec.
+func (m *PeerManager) ReplaceTrack(old, track webrtc.TrackLocal) error {
+	return m.eachSession(func(session *Session) error {
+		sender := findSender(session.PeerConnection, old)
+		if sender == nil {
+			return nil
+		}
+		if err := sender.ReplaceTrack(track); err != nil {
+			return fmt.Errorf("failed to replace track '%v': %w", old.ID(), err)
+		}
+		return nil
+	})
+}
+
+// ReplaceSessionTrack swaps old for track in the session with remoteID
+// without renegotiating. Both tracks must use the same codec.
+func (m *PeerManager) ReplaceSessionTrack(remoteID string, old, track webrtc.TrackLocal) error {
+	session, ok := m.Session(remoteID)
+	if !ok {
+		return fmt.Errorf("no session with '%v'", remoteID)
+	}
+	sender := findSender(session.PeerConnection, old)
+	if sender == nil {
+		return fmt.Errorf("'%v' is not receiving track '%v'", remoteID, old.ID())
+	}
+	if err := sender.ReplaceTrack(track); err != nil {
+		return fmt.Errorf("failed to replace track '%v' of '%v': %w", old.ID(), remoteID, err)
+	}
+	return nil
+}
+
+// SetTracks makes tracks the only tracks sent to remoteID, renegotiating if
+// that changes anything. Sessions created by Answer keep their tracks.
+func (m *PeerManager) SetTracks(remoteID string, tracks []webrtc.TrackLocal) error {
+	session, ok := m.Session(remoteID)
+	if !ok {
+		return fmt.Errorf("no session with '%v'", remoteID)
+	}
+	if session.direct {
+		return nil
+	}
+	pc := session.PeerConnection
+	wanted := make(map[webrtc.TrackLocal]bool)
+	for _, track := range tracks {
+		wanted[track] = true
+	}
+	changed := false
+	for _, sender := range pc.GetSenders() {
+		track := sender.Track()
+		if track == nil {
+			continue
+		}
+		if wanted[track] {
+			delete(wanted, track)
+			continue
+		}
+		if err := pc.RemoveTrack(sender); err != nil {
+			return fmt.Errorf("failed to remove track '%v' from '%v': %w", track.ID(), remoteID, err)
+		}
+		changed = true
+	}
+	// Keep the caller's order for the tracks we add
+	for _, track := range tracks {
+		if !wanted[track] {
+			continue
+		}
+		sender, err := pc.AddTrack(track)
+		if err != nil {
+			return fmt.Errorf("failed to add track '%v' to '%v': %w", track.ID(), remoteID, err)
+		}
+		go session.readRTCP(sender)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return session.negotiate()
+}
+
+// eachSession calls fn for every session, returning the first error
+func (m *PeerManager) eachSession(fn func(session *Session) error) error {
+	var first error
+	for _, session := range m.Sessions() {
+		if err := fn(session); err != nil {
+			err = fmt.Errorf("session with '%v': %w", session.RemoteID, err)
+			log.Warnf("%v\n", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+func findSender(pc *webrtc.PeerConnection, track webrtc.TrackLocal) *webrtc.RTPSender {
+	for _, sender := range pc.GetSenders() {
+		if sender.Track() == track {
+			return sender
+		}
+	}
+	return nil
+}
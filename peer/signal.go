@@ -0,0 +1,78 @@
+package peer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Signal types exchanged between peers over the signaling server
+const (
+	SignalOffer     = "offer"
+	SignalAnswer    = "answer"
+	SignalCandidate = "candidate"
+	// SignalBye ends the session with the peer that sends it
+	SignalBye = "bye"
+)
+
+// candidateMessage is the payload of a candidate signal
+type candidateMessage struct {
+	Type      string                  `json:"type"`
+	Candidate webrtc.ICECandidateInit `json:"candidate"`
+}
+
+// EncodeJSON encodes v as the data of a signal: base64 encoded JSON
+func EncodeJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// DecodeJSON decodes the data of a signal into v
+func DecodeJSON(data string, v interface{}) error {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return fmt.Errorf("expected base64 encoded data: %w", err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("failed to unmarshal JSON: %w", err)
+	}
+	return nil
+}
+
+func decodeDescription(data string) (webrtc.SessionDescription, error) {
+	desc := webrtc.SessionDescription{}
+	if err := DecodeJSON(data, &desc); err != nil {
+		return desc, err
+	}
+	if desc.SDP == "" {
+		return desc, fmt.Errorf("missing SDP")
+	}
+	return desc, nil
+}
+
+func decodeOffer(data string) (offerMessage, error) {
+	msg := offerMessage{}
+	if err := DecodeJSON(data, &msg); err != nil {
+		return msg, err
+	}
+	if msg.SDP == "" {
+		return msg, fmt.Errorf("missing SDP")
+	}
+	return msg, nil
+}
+
+func decodeCandidate(data string) (webrtc.ICECandidateInit, error) {
+	msg := candidateMessage{}
+	if err := DecodeJSON(data, &msg); err != nil {
+		return msg.Candidate, err
+	}
+	if msg.Candidate.Candidate == "" {
+		return msg.Candidate, fmt.Errorf("missing 'candidate'")
+	}
+	return msg.Candidate, nil
+}
@@ -0,0 +1,213 @@
+package peer
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// ntpEpochOffset is the number of seconds from the NTP epoch (1900) to the Unix epoch
+const ntpEpochOffset = 2208988800
+
+// TrackStats is what the remote peer last reported about one of our streams
+type TrackStats struct {
+	TrackID string `json:"track"`
+	SSRC    uint32 `json:"ssrc"`
+	// RTT is zero until the remote peer has seen one of our sender reports
+	RTT          time.Duration `json:"rtt"`
+	FractionLost float64       `json:"fractionLost"`
+	PacketsLost  uint32        `json:"packetsLost"`
+	Jitter       time.Duration `json:"jitter"`
+	Reports      int           `json:"reports"`
+	Updated      time.Time     `json:"updated"`
+}
+
+// Stats describes the health of a session
+type Stats struct {
+	RemoteID string                     `json:"peer"`
+	State    webrtc.PeerConnectionState `json:"state"`
+	Tracks   []TrackStats               `json:"tracks"`
+	// BytesSent and BytesReceived count everything on the ICE transport
+	BytesSent     uint64 `json:"bytesSent"`
+	BytesReceived uint64 `json:"bytesReceived"`
+	// ICERTT is measured by ICE on the nominated candidate pair
+	ICERTT time.Duration `json:"iceRtt"`
+	// Bitrate is the estimated bitrate we may send at, if estimation is enabled
+	Bitrate int `json:"bitrate,omitempty"`
+}
+
+// readRTCP records the receiver reports about rtpSender's stream until the
+// sender is stopped. RTCP must be read for interceptors such as NACK to work,
+// so packets we cannot parse are skipped rather than ending the loop.
+func (s *Session) readRTCP(rtpSender *webrtc.RTPSender) {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := rtpSender.Read(buf)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) {
+			return
+		}
+		if err != nil {
+			log.Debugf("Failed to read RTCP from '%v': %v\n", s.RemoteID, err)
+			continue
+		}
+		packets, err := rtcp.Unmarshal(buf[:n])
+		if err != nil {
+			log.Debugf("Skipped RTCP from '%v': %v\n", s.RemoteID, err)
+			continue
+		}
+		now := time.Now()
+		for _, packet := range packets {
+			switch packet := packet.(type) {
+			case *rtcp.ReceiverReport:
+				s.recordReports(rtpSender, packet.Reports, now)
+			case *rtcp.SenderReport:
+				s.recordReports(rtpSender, packet.Reports, now)
+			case *rtcp.TransportLayerCC:
+				if s.estimator != nil {
+					s.estimator.onLoss(twccLoss(packet), now)
+				}
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				if s.estimator != nil {
+					s.estimator.onREMB(float64(packet.Bitrate))
+				}
+			}
+		}
+		s.reportBitrate()
+	}
+}
+
+func (s *Session) recordReports(rtpSender *webrtc.RTPSender, reports []rtcp.ReceptionReport, now time.Time) {
+	trackID := ""
+	if track := rtpSender.Track(); track != nil {
+		trackID = track.ID()
+	}
+	clockRate := senderClockRate(rtpSender)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, report := range reports {
+		stats, ok := s.trackStats[report.SSRC]
+		if !ok {
+			stats = &TrackStats{SSRC: report.SSRC}
+			s.trackStats[report.SSRC] = stats
+		}
+		stats.TrackID = trackID
+		stats.RTT = roundTripTime(report, now)
+		stats.FractionLost = float64(report.FractionLost) / 256
+		stats.PacketsLost = report.TotalLost
+		if clockRate > 0 {
+			stats.Jitter = time.Duration(uint64(report.Jitter) * uint64(time.Second) / uint64(clockRate))
+		}
+		stats.Reports++
+		stats.Updated = now
+		if s.estimator != nil {
+			s.estimator.onLoss(stats.FractionLost, now)
+		}
+	}
+}
+
+// senderClockRate returns the clock rate of the codec rtpSender sends. The
+// track knows it once negotiated. Before that we fall back to the first codec
+// the sender could use.
+func senderClockRate(rtpSender *webrtc.RTPSender) uint32 {
+	if track, ok := rtpSender.Track().(interface {
+		Codec() webrtc.RTPCodecCapability
+	}); ok {
+		if clockRate := track.Codec().ClockRate; clockRate > 0 {
+			return clockRate
+		}
+	}
+	if codecs := rtpSender.GetParameters().Codecs; len(codecs) > 0 {
+		return codecs[0].ClockRate
+	}
+	return 0
+}
+
+// reportBitrate tells onBitrate about significant changes of the estimate
+func (s *Session) reportBitrate() {
+	if s.estimator == nil || s.onBitrate == nil {
+		return
+	}
+	if bps, changed := s.estimator.changed(); changed {
+		s.onBitrate(bps)
+	}
+}
+
+// ntpMiddle returns the middle 32 bits of the NTP timestamp for t, as used in reception reports
+func ntpMiddle(t time.Time) uint32 {
+	seconds := uint64(t.Unix()) + ntpEpochOffset
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return uint32(seconds<<16 | fraction>>16)
+}
+
+// roundTripTime computes the RTT from a reception report received at now (RFC 3550 section 6.4.1)
+func roundTripTime(report rtcp.ReceptionReport, now time.Time) time.Duration {
+	if report.LastSenderReport == 0 {
+		return 0
+	}
+	rtt := int32(ntpMiddle(now) - report.LastSenderReport - report.Delay)
+	if rtt < 0 {
+		return 0
+	}
+	return time.Duration(int64(rtt) * int64(time.Second) >> 16)
+}
+
+// Stats returns the session's statistics, combining receiver reports with GetStats
+func (s *Session) Stats() Stats {
+	stats := Stats{
+		RemoteID: s.RemoteID,
+		State:    s.PeerConnection.ConnectionState(),
+	}
+	for _, report := range s.PeerConnection.GetStats() {
+		switch report := report.(type) {
+		case webrtc.TransportStats:
+			stats.BytesSent += report.BytesSent
+			stats.BytesReceived += report.BytesReceived
+		case webrtc.ICECandidatePairStats:
+			if report.Nominated {
+				stats.ICERTT = time.Duration(report.CurrentRoundTripTime * float64(time.Second))
+			}
+		}
+	}
+	if s.estimator != nil {
+		stats.Bitrate = s.estimator.bitrate()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats.Tracks = make([]TrackStats, 0, len(s.trackStats))
+	for _, track := range s.trackStats {
+		stats.Tracks = append(stats.Tracks, *track)
+	}
+	sort.Slice(stats.Tracks, func(i, j int) bool {
+		return stats.Tracks[i].SSRC < stats.Tracks[j].SSRC
+	})
+	return stats
+}
+
+// Stats returns the statistics of every session
+func (m *PeerManager) Stats() []Stats {
+	sessions := m.Sessions()
+	result := make([]Stats, 0, len(sessions))
+	for _, session := range sessions {
+		result = append(result, session.Stats())
+	}
+	return result
+}
+
+// LogStats logs the statistics of every session
+func (m *PeerManager) LogStats() {
+	for _, stats := range m.Stats() {
+		logStats(stats)
+	}
+}
+
+func logStats(stats Stats) {
+	log.Infof("Peer '%v': state=%v sent=%vB received=%vB ice-rtt=%v bitrate=%vbps\n", stats.RemoteID, stats.State, stats.BytesSent, stats.BytesReceived, stats.ICERTT, stats.Bitrate)
+	for _, track := range stats.Tracks {
+		log.Infof("Peer '%v' track '%v': rtt=%v lost=%.1f%% (%v total) jitter=%v\n", stats.RemoteID, track.TrackID, track.RTT, track.FractionLost*100, track.PacketsLost, track.Jitter)
+	}
+}
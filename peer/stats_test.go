@@ -0,0 +1,45 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTripTime(t *testing.T) {
+	require := require.New(t)
+
+	sent := time.Unix(1700000000, 250000000)
+	received := sent.Add(130 * time.Millisecond)
+	report := rtcp.ReceptionReport{
+		LastSenderReport: ntpMiddle(sent),
+		// The remote peer held on to our report for 30ms
+		Delay: uint32(30 * time.Millisecond * 65536 / time.Second),
+	}
+	require.InDelta(float64(100*time.Millisecond), float64(roundTripTime(report, received)), float64(time.Millisecond))
+
+	// No sender report seen yet
+	require.Zero(roundTripTime(rtcp.ReceptionReport{}, received))
+	// A delay longer than the time elapsed is nonsense
+	report.Delay = uint32(time.Second * 65536 / time.Second)
+	require.Zero(roundTripTime(report, received))
+}
+
+func TestSenderClockRate(t *testing.T) {
+	require := require.New(t)
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.Nil(err)
+	defer pc.Close()
+	opus, err := pc.AddTrack(newTestTrack(t))
+	require.Nil(err)
+	require.Equal(uint32(48000), senderClockRate(opus))
+	pcmu, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, "pcmu", "test")
+	require.Nil(err)
+	sender, err := pc.AddTrack(pcmu)
+	require.Nil(err)
+	require.Equal(uint32(8000), senderClockRate(sender))
+}
@@ -0,0 +1,270 @@
+package dhwani_backend_p2p
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrNotConnected is returned when writing while the connection is down
+	ErrNotConnected = errors.New("not connected to server")
+	// ErrClosed is returned once the connection has been closed for good
+	ErrClosed = errors.New("server connection closed")
+	// ErrQueueFull is returned when the outbound queue cannot take another message
+	ErrQueueFull = errors.New("outbound queue full")
+)
+
+// ConnState is the state of the connection to the signaling server
+type ConnState int
+
+const (
+	StateConnecting ConnState = iota
+	StateConnected
+	StateDisconnected
+)
+
+func (c ConnState) String() string {
+	switch c {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	default:
+		return fmt.Sprintf("ConnState(%d)", int(c))
+	}
+}
+
+// Backoff controls the delay between reconnection attempts
+type Backoff struct {
+	// Min is the delay before the first retry. Defaults to 500ms
+	Min time.Duration
+	// Max caps the delay. Defaults to 30s
+	Max time.Duration
+	// Factor multiplies the delay after each failed attempt. Defaults to 2
+	Factor float64
+	// Jitter randomizes each delay between Min and the computed value
+	Jitter bool
+}
+
+// DefaultBackoff returns the backoff used when ServerOptions leaves it empty
+func DefaultBackoff() Backoff {
+	return Backoff{
+		Min:    500 * time.Millisecond,
+		Max:    30 * time.Second,
+		Factor: 2,
+		Jitter: true,
+	}
+}
+
+func (b Backoff) withDefaults() Backoff {
+	def := DefaultBackoff()
+	if b.Min <= 0 {
+		b.Min = def.Min
+	}
+	if b.Max <= 0 {
+		b.Max = def.Max
+	}
+	if b.Max < b.Min {
+		b.Max = b.Min
+	}
+	if b.Factor < 1 {
+		b.Factor = def.Factor
+	}
+	return b
+}
+
+// Duration returns the delay before retry number attempt (starting at 0)
+func (b Backoff) Duration(attempt int) time.Duration {
+	b = b.withDefaults()
+	d := float64(b.Min)
+	for i := 0; i < attempt && d < float64(b.Max); i++ {
+		d *= b.Factor
+	}
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if b.Jitter && d > float64(b.Min) {
+		d = float64(b.Min) + rand.Float64()*(d-float64(b.Min))
+	}
+	return time.Duration(d)
+}
+
+// reconnectingConn redials the server with backoff whenever the connection
+// drops. Reads block while reconnecting; writes fail with ErrNotConnected.
+type reconnectingConn struct {
+	dial    func() (*websocket.Conn, error)
+	backoff Backoff
+	onState func(ConnState)
+
+	mutex sync.Mutex
+	conn  *websocket.Conn
+	ready chan struct{}
+	done  chan struct{}
+	// closed is set once Close is called
+	closed bool
+}
+
+func newReconnectingConn(dial func() (*websocket.Conn, error), backoff Backoff) *reconnectingConn {
+	return &reconnectingConn{
+		dial:    dial,
+		backoff: backoff.withDefaults(),
+		onState: func(ConnState) {},
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// start makes the first connection attempt and keeps retrying in the
+// background if it fails
+func (r *reconnectingConn) start() error {
+	r.onState(StateConnecting)
+	conn, err := r.dial()
+	if err != nil {
+		r.onState(StateDisconnected)
+		go r.redial()
+		return err
+	}
+	r.connected(conn)
+	return nil
+}
+
+func (r *reconnectingConn) connected(conn *websocket.Conn) {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	r.conn = conn
+	close(r.ready)
+	r.mutex.Unlock()
+	r.onState(StateConnected)
+}
+
+func (r *reconnectingConn) redial() {
+	for attempt := 0; ; attempt++ {
+		delay := r.backoff.Duration(attempt)
+		select {
+		case <-r.done:
+			return
+		case <-time.After(delay):
+		}
+		r.onState(StateConnecting)
+		conn, err := r.dial()
+		if err == nil {
+			r.connected(conn)
+			return
+		}
+		log.Debugf("Reconnect attempt %v failed: %v\n", attempt+1, err)
+		r.onState(StateDisconnected)
+	}
+}
+
+// drop tears down conn after an I/O error and starts reconnecting
+func (r *reconnectingConn) drop(conn *websocket.Conn, cause error) {
+	r.mutex.Lock()
+	if r.closed || r.conn != conn {
+		// Closed, or somebody else already noticed
+		r.mutex.Unlock()
+		return
+	}
+	r.conn.Close()
+	r.conn = nil
+	r.ready = make(chan struct{})
+	r.mutex.Unlock()
+	log.Warnf("Lost connection to server: %v\n", cause)
+	r.onState(StateDisconnected)
+	go r.redial()
+}
+
+// reconnect drops the current connection, if any, and starts reconnecting
+func (r *reconnectingConn) reconnect(cause error) {
+	r.mutex.Lock()
+	conn := r.conn
+	r.mutex.Unlock()
+	if conn != nil {
+		r.drop(conn, cause)
+	}
+}
+
+// current returns the live connection, waiting for a reconnect if necessary
+func (r *reconnectingConn) current() (*websocket.Conn, error) {
+	for {
+		r.mutex.Lock()
+		conn, ready, closed := r.conn, r.ready, r.closed
+		r.mutex.Unlock()
+		if closed {
+			return nil, ErrClosed
+		}
+		if conn != nil {
+			return conn, nil
+		}
+		select {
+		case <-ready:
+		case <-r.done:
+		}
+	}
+}
+
+func (r *reconnectingConn) ReadMessage() (int, []byte, error) {
+	for {
+		conn, err := r.current()
+		if err != nil {
+			return 0, nil, err
+		}
+		messageType, b, err := conn.ReadMessage()
+		if err == nil {
+			return messageType, b, nil
+		}
+		r.drop(conn, err)
+	}
+}
+
+func (r *reconnectingConn) WriteMessage(messageType int, data []byte) error {
+	r.mutex.Lock()
+	conn, closed := r.conn, r.closed
+	r.mutex.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if conn == nil {
+		return ErrNotConnected
+	}
+	if err := conn.WriteMessage(messageType, data); err != nil {
+		r.drop(conn, err)
+		return fmt.Errorf("%w: %v", ErrNotConnected, err)
+	}
+	return nil
+}
+
+func (r *reconnectingConn) writeControl(messageType int, data []byte, deadline time.Time) error {
+	r.mutex.Lock()
+	conn := r.conn
+	r.mutex.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return conn.WriteControl(messageType, data, deadline)
+}
+
+func (r *reconnectingConn) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	if r.conn != nil {
+		return r.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package dhwani_backend_p2p
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffDuration(t *testing.T) {
+	require := require.New(t)
+
+	b := Backoff{Min: 100 * time.Millisecond, Max: time.Second, Factor: 2}
+	require.Equal(100*time.Millisecond, b.Duration(0))
+	require.Equal(200*time.Millisecond, b.Duration(1))
+	require.Equal(800*time.Millisecond, b.Duration(3))
+	require.Equal(time.Second, b.Duration(4))
+	require.Equal(time.Second, b.Duration(100))
+
+	b.Jitter = true
+	for i := 0; i < 100; i++ {
+		d := b.Duration(3)
+		require.GreaterOrEqual(d, 100*time.Millisecond)
+		require.LessOrEqual(d, 800*time.Millisecond)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	require := require.New(t)
+
+	var allow int32 = 1
+	received := make(chan string, 10)
+	conns := make(chan *websocket.Conn, 10)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&allow) == 0 {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- conn
+		for {
+			_, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- string(b)
+		}
+	}))
+	defer server.Close()
+
+	states := make(chan ConnState, 20)
+	reconnected := make(chan struct{}, 1)
+
+	conn, err := NewServerConnectionWithOptions("b", ServerOptions{
+		URL:           "ws" + strings.TrimPrefix(server.URL, "http"),
+		DialTimeout:   time.Second,
+		AutoReconnect: true,
+		Backoff:       Backoff{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond},
+		QueueSize:     2,
+	})
+	require.Nil(err)
+	defer conn.Close()
+	require.Equal(StateConnected, conn.State())
+	conn.OnStateChange(func(state ConnState) {
+		states <- state
+	})
+	conn.OnReconnect(func() {
+		reconnected <- struct{}{}
+	})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn.Loop()
+	}()
+
+	first := <-conns
+	atomic.StoreInt32(&allow, 0)
+	first.Close()
+	require.Equal(StateDisconnected, <-states)
+
+	// Written while down; must arrive in order once we are back
+	require.Nil(conn.WriteMessage(websocket.TextMessage, []byte("one")))
+	require.Nil(conn.WriteMessage(websocket.TextMessage, []byte("two")))
+	require.Equal(ErrQueueFull, conn.WriteMessage(websocket.TextMessage, []byte("three")))
+
+	atomic.StoreInt32(&allow, 1)
+	select {
+	case <-reconnected:
+	case <-time.After(2 * time.Second):
+		require.Fail("timed out waiting for reconnect")
+	}
+	require.Equal(StateConnected, conn.State())
+	require.Equal("one", <-received)
+	require.Equal("two", <-received)
+
+	conn.Close()
+	wg.Wait()
+}
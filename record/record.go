@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"os/exec"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -11,9 +12,14 @@ import (
 type recorder struct {
 	cmdline string
 	proc    *exec.Cmd
+	// err is returned by Start when the pipeline could not be built
+	err error
 }
 
 func (r *recorder) Start() error {
+	if r.err != nil {
+		return r.err
+	}
 	stdout, _ := r.proc.StdoutPipe()
 	stderr, _ := r.proc.StderrPipe()
 	go func() {
@@ -44,7 +50,81 @@ func (r *recorder) Start() error {
 }
 
 func (r *recorder) Stop() error {
-	return r.proc.Process.Kill()
+	if r.proc == nil || r.proc.Process == nil {
+		return fmt.Errorf("recorder was not started")
+	}
+	if err := r.proc.Process.Kill(); err != nil {
+		return err
+	}
+	// Reap the process so that it does not linger as a zombie. Being killed is its exit status
+	r.proc.Wait()
+	return nil
+}
+
+// Output is one encoding of a recording, sent as RTP to a local port
+type Output struct {
+	Port int
+	// Codec is the MIME type of the encoding, e.g. "audio/PCMU". Empty means Opus
+	Codec string
+	// Bitrate in bits per second, for Opus. 0 leaves it to the encoder
+	Bitrate int
+	// Channels to encode, for Opus. 0 keeps those of the recording
+	Channels int
+}
+
+// encoders holds the gst-launch elements that encode raw audio as RTP for
+// each codec other than Opus, keyed by lower case MIME type
+var encoders = map[string]string{
+	"audio/pcmu": "audioconvert ! audioresample ! audio/x-raw,rate=8000,channels=1 ! mulawenc ! rtppcmupay",
+	"audio/pcma": "audioconvert ! audioresample ! audio/x-raw,rate=8000,channels=1 ! alawenc ! rtppcmapay",
+	"audio/g722": "audioconvert ! audioresample ! audio/x-raw,rate=16000,channels=1 ! avenc_g722 ! rtpg722pay",
+	// Stay below the path MTU. Uncompressed packets are large
+	"audio/l16": "audioconvert ! audioresample ! audio/x-raw,format=S16BE,rate=48000,channels=2 ! rtpL16pay mtu=1200",
+}
+
+// parsePipeline returns the gst-launch element that parses the raw audio of a
+// recording with as many channels as the outputs need
+func parsePipeline(outputs []Output) string {
+	channels := 0
+	for _, output := range outputs {
+		if output.Channels > channels {
+			channels = output.Channels
+		}
+	}
+	if channels == 0 {
+		return "rawaudioparse"
+	}
+	return fmt.Sprintf("rawaudioparse num-channels=%v", channels)
+}
+
+// encodePipeline returns the gst-launch elements that encode raw audio into each output
+func encodePipeline(outputs []Output) (string, error) {
+	branches := make([]string, 0, len(outputs))
+	for _, output := range outputs {
+		encoder, ok := encoders[strings.ToLower(output.Codec)]
+		switch {
+		case output.Codec == "" || strings.EqualFold(output.Codec, "audio/opus") || strings.EqualFold(output.Codec, "audio/multiopus"):
+			encoder = "opusenc frame-size=20"
+			if output.Channels > 2 {
+				// opusenc only takes more than two channels as multistream Opus
+				encoder += " channel-mapping-family=1"
+			}
+			if output.Channels > 0 {
+				encoder = fmt.Sprintf("audioconvert ! audio/x-raw,channels=%v ! %v", output.Channels, encoder)
+			}
+			if output.Bitrate > 0 {
+				encoder += fmt.Sprintf(" bitrate=%v", output.Bitrate)
+			}
+			encoder += " ! rtpopuspay"
+		case !ok:
+			return "", fmt.Errorf("cannot encode '%v'", output.Codec)
+		}
+		branches = append(branches, fmt.Sprintf("%v ! udpsink host=127.0.0.1 port=%v", encoder, output.Port))
+	}
+	if len(branches) == 1 {
+		return branches[0], nil
+	}
+	return "tee name=t t. ! queue ! " + strings.Join(branches, " t. ! queue ! "), nil
 }
 
 type Recorder interface {
@@ -4,12 +4,24 @@ import (
 	"fmt"
 	"os/exec"
 	"strings"
+	"syscall"
 )
 
 func NewRecorder(identifier string, port int) Recorder {
+	return NewTieredRecorder(identifier, []Output{{Port: port}})
+}
+
+// NewTieredRecorder encodes the device once for every output
+func NewTieredRecorder(identifier string, outputs []Output) Recorder {
+	pipeline, err := encodePipeline(outputs)
+	if err != nil {
+		return &recorder{err: err}
+	}
 	prog := "gst-launch-1.0"
-	args := fmt.Sprintf("alsasrc device=%v latency-time=1500 buffer-time=10000 ! queue ! rawaudioparse ! audioresample ! opusenc frame-size=20 ! rtpopuspay ! udpsink host=127.0.0.1 port=%v", identifier, port)
+	args := fmt.Sprintf("alsasrc device=%v latency-time=1500 buffer-time=10000 ! queue ! %v ! audioresample ! %v", identifier, parsePipeline(outputs), pipeline)
 	cmd := exec.Command(prog, strings.Split(args, " ")...)
+	// Do not leave the pipeline sending to the port if we die without stopping it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
 	return &recorder{
 		cmdline: fmt.Sprintf("%v %v", cmd, args),
 		proc:    cmd,
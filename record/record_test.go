@@ -0,0 +1,38 @@
+package record
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodePipeline(t *testing.T) {
+	require := require.New(t)
+
+	pipeline, err := encodePipeline([]Output{{Port: 3131}})
+	require.Nil(err)
+	require.Equal("opusenc frame-size=20 ! rtpopuspay ! udpsink host=127.0.0.1 port=3131", pipeline)
+
+	pipeline, err = encodePipeline([]Output{{Port: 4000, Bitrate: 24000}, {Port: 4001, Bitrate: 128000}})
+	require.Nil(err)
+	require.Equal("tee name=t t. ! queue ! opusenc frame-size=20 bitrate=24000 ! rtpopuspay ! udpsink host=127.0.0.1 port=4000 t. ! queue ! opusenc frame-size=20 bitrate=128000 ! rtpopuspay ! udpsink host=127.0.0.1 port=4001", pipeline)
+
+	pipeline, err = encodePipeline([]Output{{Port: 4000, Codec: "audio/opus"}, {Port: 4001, Codec: "audio/PCMU"}})
+	require.Nil(err)
+	require.Equal("tee name=t t. ! queue ! opusenc frame-size=20 ! rtpopuspay ! udpsink host=127.0.0.1 port=4000 t. ! queue ! audioconvert ! audioresample ! audio/x-raw,rate=8000,channels=1 ! mulawenc ! rtppcmupay ! udpsink host=127.0.0.1 port=4001", pipeline)
+
+	outputs := []Output{{Port: 4000, Codec: "audio/multiopus", Channels: 6}, {Port: 4001, Channels: 2}}
+	pipeline, err = encodePipeline(outputs)
+	require.Nil(err)
+	require.Equal("tee name=t t. ! queue ! audioconvert ! audio/x-raw,channels=6 ! opusenc frame-size=20 channel-mapping-family=1 ! rtpopuspay ! udpsink host=127.0.0.1 port=4000 t. ! queue ! audioconvert ! audio/x-raw,channels=2 ! opusenc frame-size=20 ! rtpopuspay ! udpsink host=127.0.0.1 port=4001", pipeline)
+	require.Equal("rawaudioparse num-channels=6", parsePipeline(outputs))
+	require.Equal("rawaudioparse", parsePipeline([]Output{{Port: 4000}}))
+
+	pipeline, err = encodePipeline([]Output{{Port: 4000, Codec: "audio/multiopus", Channels: 8, Bitrate: 256000}})
+	require.Nil(err)
+	require.Equal("audioconvert ! audio/x-raw,channels=8 ! opusenc frame-size=20 channel-mapping-family=1 bitrate=256000 ! rtpopuspay ! udpsink host=127.0.0.1 port=4000", pipeline)
+
+	_, err = encodePipeline([]Output{{Port: 4000, Codec: "audio/AMR"}})
+	require.NotNil(err)
+	require.NotNil(NewTieredRecorder("hw:0", []Output{{Port: 4000, Codec: "audio/AMR"}}).Start())
+}
@@ -1,8 +1,23 @@
 package record
 
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
 func NewRecorder(identifier string, port int) Recorder {
+	return NewTieredRecorder(identifier, []Output{{Port: port}})
+}
+
+// NewTieredRecorder encodes the device once for every output
+func NewTieredRecorder(identifier string, outputs []Output) Recorder {
+	pipeline, err := encodePipeline(outputs)
+	if err != nil {
+		return &recorder{err: err}
+	}
 	prog := "gst-launch-1.0"
-	args := fmt.Sprintf("wasapisrc device=%v low-latency=true ! queue ! rawaudioparse ! audioresample ! opusenc frame-size=20 ! rtpopuspay ! udpsink host=127.0.0.1 port=%v", identifier, port)
+	args := fmt.Sprintf("wasapisrc device=%v low-latency=true ! queue ! %v ! audioresample ! %v", identifier, parsePipeline(outputs), pipeline)
 	cmd := exec.Command(prog, strings.Split(args, " ")...)
 	return &recorder{
 		cmdline: fmt.Sprintf("%v %v", cmd, args),
@@ -0,0 +1,117 @@
+package dhwani_backend_p2p
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// PresenceEvent describes a peer joining or leaving a room we are in
+type PresenceEvent struct {
+	Room string
+	Peer string
+}
+
+// JoinRoom joins room and returns the IDs of the peers already in it
+func (s *ServerConn) JoinRoom(ctx context.Context, room string) ([]string, error) {
+	members, err := s.roomRequest(ctx, ActionJoin, room)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join room '%v': %w", room, err)
+	}
+	s.mutex.Lock()
+	s.rooms[room] = struct{}{}
+	s.mutex.Unlock()
+	return members, nil
+}
+
+// LeaveRoom leaves room
+func (s *ServerConn) LeaveRoom(ctx context.Context, room string) error {
+	s.mutex.Lock()
+	delete(s.rooms, room)
+	s.mutex.Unlock()
+	_, err := s.request(ctx, func(id string) interface{} {
+		return RoomMessage{Action: ActionLeave, ID: id, Room: room}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to leave room '%v': %w", room, err)
+	}
+	return nil
+}
+
+// ListRoom returns the IDs of the peers in room other than ourselves
+func (s *ServerConn) ListRoom(ctx context.Context, room string) ([]string, error) {
+	members, err := s.roomRequest(ctx, ActionListRoom, room)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list room '%v': %w", room, err)
+	}
+	return members, nil
+}
+
+// Rooms returns the rooms this connection has joined
+func (s *ServerConn) Rooms() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rooms := make([]string, 0, len(s.rooms))
+	for room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+func (s *ServerConn) roomRequest(ctx context.Context, action string, room string) ([]string, error) {
+	raw, err := s.request(ctx, func(id string) interface{} {
+		return RoomMessage{Action: action, ID: id, Room: room}
+	})
+	if err != nil {
+		return nil, err
+	}
+	var msg RoomMembersMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return nil, err
+	}
+	if msg.Action != ActionRoomMembers {
+		return nil, fmt.Errorf("unexpected reply '%v'", msg.Action)
+	}
+	return msg.Members, nil
+}
+
+// OnPeerJoined registers cb for peers joining any room we are in.
+// The returned function unregisters it.
+func (s *ServerConn) OnPeerJoined(cb func(PresenceEvent)) func() {
+	return s.onPresence(ActionPeerJoined, cb)
+}
+
+// OnPeerLeft registers cb for peers leaving any room we are in, including by disconnecting.
+// The returned function unregisters it.
+func (s *ServerConn) OnPeerLeft(cb func(PresenceEvent)) func() {
+	return s.onPresence(ActionPeerLeft, cb)
+}
+
+func (s *ServerConn) onPresence(action string, cb func(PresenceEvent)) func() {
+	return s.OnAction(action, func(raw json.RawMessage) error {
+		var msg PresenceMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			return err
+		}
+		if msg.Room == "" || msg.Peer == "" {
+			return fmt.Errorf("missing 'room' or 'peer'")
+		}
+		cb(PresenceEvent{Room: msg.Room, Peer: msg.Peer})
+		return nil
+	})
+}
+
+func ignorePresence(raw json.RawMessage) error {
+	return nil
+}
+
+func (s *ServerConn) handleRoomMembers(raw json.RawMessage) error {
+	var msg RoomMembersMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return err
+	}
+	if !s.resolve(msg.ID, raw, nil) {
+		return fmt.Errorf("unsolicited member list for room '%v'", msg.Room)
+	}
+	return nil
+}
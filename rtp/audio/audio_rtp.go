@@ -7,7 +7,6 @@ import (
 	"sync"
 
 	"github.com/pion/rtp"
-	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v3"
 	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
 	log "github.com/sirupsen/logrus"
@@ -15,12 +14,15 @@ import (
 
 type AudioRTP struct {
 	Port     int
+	Codec    Codec
 	listener *net.UDPConn
-	Track    *webrtc.TrackLocalStaticSample
-	mutex    sync.Mutex
-	wg       sync.WaitGroup
-	running  bool
-	stopped  bool
+	// Track is a *webrtc.TrackLocalStaticSample, or a *webrtc.TrackLocalStaticRTP
+	// for codecs that are forwarded as they are
+	Track   webrtc.TrackLocal
+	mutex   sync.Mutex
+	wg      sync.WaitGroup
+	running bool
+	stopped bool
 }
 
 func (artp *AudioRTP) Loop() {
@@ -42,7 +44,10 @@ func (artp *AudioRTP) Loop() {
 	}()
 
 	once := false
-	audioBuilder := samplebuilder.New(3, &codecs.OpusPacket{}, 48000)
+	var audioBuilder *samplebuilder.SampleBuilder
+	if artp.Codec.newDepacketizer != nil {
+		audioBuilder = samplebuilder.New(3, artp.Codec.newDepacketizer(), artp.Codec.Capability.ClockRate)
+	}
 
 	for {
 		packet := &rtp.Packet{}
@@ -60,7 +65,15 @@ func (artp *AudioRTP) Loop() {
 		}
 
 		if err = packet.Unmarshal(inboundRTPPacket[:n]); err != nil {
-			log.Fatalf("Failed to unmarshal RTP packet: %v\n", err)
+			log.Warnf("Dropping malformed RTP packet on port %v: %v\n", artp.Port, err)
+			continue
+		}
+		if audioBuilder == nil {
+			// Write errors are those of a single listener. Drop the packet rather than the stream
+			if err := artp.Track.(*webrtc.TrackLocalStaticRTP).WriteRTP(packet); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				log.Warnf("Failed to forward RTP packet: %v\n", err)
+			}
+			continue
 		}
 		audioBuilder.Push(packet)
 		for {
@@ -69,12 +82,12 @@ func (artp *AudioRTP) Loop() {
 				break
 			}
 
-			if writeErr := artp.Track.WriteSample(*sample); writeErr != nil {
-				if errors.Is(err, io.ErrClosedPipe) {
+			if writeErr := artp.Track.(*webrtc.TrackLocalStaticSample).WriteSample(*sample); writeErr != nil {
+				if errors.Is(writeErr, io.ErrClosedPipe) {
 					// The peerConnection has been closed.
 					break
 				}
-				panic(err)
+				log.Warnf("Failed to write audio sample: %v\n", writeErr)
 			}
 		}
 	}
@@ -92,26 +105,45 @@ func (rtp *AudioRTP) Stop() {
 }
 
 func SetupExternalRTP(port int) *AudioRTP {
+	artp, err := NewAudioRTP(port, "audio", "pion")
+	if err != nil {
+		panic(err)
+	}
+	return artp
+}
+
+// NewAudioRTP listens for Opus RTP on port and writes it to a track with the
+// given IDs. A port of 0 picks a free port, which is then available as Port.
+func NewAudioRTP(port int, trackID string, streamID string) (*AudioRTP, error) {
+	return NewCodecRTP(port, Opus, trackID, streamID)
+}
+
+// NewCodecRTP is NewAudioRTP for RTP carrying codec
+func NewCodecRTP(port int, codec Codec, trackID string, streamID string) (*AudioRTP, error) {
 	// Open a UDP Listener for RTP Packets on port
 	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// Create audio track
-	audioTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
+	var audioTrack webrtc.TrackLocal
+	if codec.newDepacketizer != nil {
+		audioTrack, err = webrtc.NewTrackLocalStaticSample(codec.Capability, trackID, streamID)
+	} else {
+		audioTrack, err = webrtc.NewTrackLocalStaticRTP(codec.Capability, trackID, streamID)
+	}
 	if err != nil {
-		panic(err)
+		listener.Close()
+		return nil, err
 	}
 
 	// Read RTP packets forever and send them to the WebRTC Client
 	return &AudioRTP{
-		port,
-		listener,
-		audioTrack,
-		sync.Mutex{},
-		sync.WaitGroup{},
-		false,
-		true,
-	}
+		Port:     listener.LocalAddr().(*net.UDPAddr).Port,
+		Codec:    codec,
+		listener: listener,
+		Track:    audioTrack,
+		stopped:  true,
+	}, nil
 }
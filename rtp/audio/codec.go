@@ -0,0 +1,134 @@
+package audio
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// MimeTypeL16 is uncompressed 16 bit big-endian PCM (RFC 3551 section 4.5.11)
+const MimeTypeL16 = "audio/L16"
+
+// MimeTypeMultiOpus is Opus with more than two channels, as Chrome signals it
+const MimeTypeMultiOpus = "audio/multiopus"
+
+// opusFmtp holds the format parameters every Opus encoding is signaled with
+const opusFmtp = "minptime=10;useinbandfec=1"
+
+// opusLayout is how an Opus multistream packet carries its channels
+type opusLayout struct {
+	streams, coupled int
+	mapping          []int
+}
+
+// opusLayouts are the Vorbis channel orders of mapping family 1, by channel
+// count (RFC 7845 section 5.1.1.2). 6 is 5.1 and 8 is 7.1
+var opusLayouts = map[int]opusLayout{
+	3: {2, 1, []int{0, 2, 1}},
+	4: {2, 2, []int{0, 1, 2, 3}},
+	5: {3, 2, []int{0, 4, 1, 2, 3}},
+	6: {4, 2, []int{0, 4, 1, 2, 3, 5}},
+	7: {4, 3, []int{0, 4, 1, 2, 3, 5, 6}},
+	8: {5, 3, []int{0, 6, 1, 2, 3, 4, 5, 7}},
+}
+
+// Codec is an audio encoding AudioRTP can forward
+type Codec struct {
+	Name       string
+	Capability webrtc.RTPCodecCapability
+	// newDepacketizer is nil for codecs whose packets are forwarded as they are,
+	// because pion cannot packetize them again
+	newDepacketizer func() rtp.Depacketizer
+}
+
+var (
+	Opus = Codec{
+		Name:            "opus",
+		Capability:      webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: opusFmtp},
+		newDepacketizer: func() rtp.Depacketizer { return &codecs.OpusPacket{} },
+	}
+	PCMU = Codec{
+		Name:            "pcmu",
+		Capability:      webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000},
+		newDepacketizer: func() rtp.Depacketizer { return &rawPacket{} },
+	}
+	PCMA = Codec{
+		Name:            "pcma",
+		Capability:      webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000},
+		newDepacketizer: func() rtp.Depacketizer { return &rawPacket{} },
+	}
+	// G722 samples at 16 kHz but its RTP clock runs at 8 kHz (RFC 3551 section 4.5.2)
+	G722 = Codec{
+		Name:            "g722",
+		Capability:      webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeG722, ClockRate: 8000},
+		newDepacketizer: func() rtp.Depacketizer { return &rawPacket{} },
+	}
+	L16 = Codec{
+		Name:       "l16",
+		Capability: webrtc.RTPCodecCapability{MimeType: MimeTypeL16, ClockRate: 48000, Channels: 2},
+	}
+)
+
+// OpusCodec returns Opus for audio with the given number of channels. Stereo
+// is signaled with stereo=1 and sprop-stereo=1. More than two channels use
+// multiopus, which pion cannot packetize, so its packets are forwarded
+func OpusCodec(channels int) (Codec, error) {
+	switch {
+	case channels == 1:
+		codec := Opus
+		codec.Capability.SDPFmtpLine = opusFmtp
+		return codec, nil
+	case channels == 2:
+		codec := Opus
+		codec.Capability.SDPFmtpLine = opusFmtp + ";stereo=1;sprop-stereo=1"
+		return codec, nil
+	}
+	layout, ok := opusLayouts[channels]
+	if !ok {
+		return Codec{}, fmt.Errorf("opus cannot carry %v channels", channels)
+	}
+	mapping := make([]string, 0, len(layout.mapping))
+	for _, channel := range layout.mapping {
+		mapping = append(mapping, fmt.Sprint(channel))
+	}
+	fmtp := fmt.Sprintf("channel_mapping=%v;num_streams=%v;coupled_streams=%v;%v", strings.Join(mapping, ","), layout.streams, layout.coupled, opusFmtp)
+	return Codec{
+		Name:       "multiopus",
+		Capability: webrtc.RTPCodecCapability{MimeType: MimeTypeMultiOpus, ClockRate: 48000, Channels: uint16(channels), SDPFmtpLine: fmtp},
+	}, nil
+}
+
+// Codecs lists every supported codec
+var Codecs = []Codec{Opus, PCMU, PCMA, G722, L16}
+
+// LookupCodec finds a codec by name or MIME type, ignoring case
+func LookupCodec(name string) (Codec, error) {
+	for _, codec := range Codecs {
+		if strings.EqualFold(name, codec.Name) || strings.EqualFold(name, codec.Capability.MimeType) {
+			return codec, nil
+		}
+	}
+	return Codec{}, fmt.Errorf("unsupported codec '%v'", name)
+}
+
+// rawPacket depacketizes codecs whose payload is just the encoded audio, one
+// complete frame per packet
+type rawPacket struct{}
+
+func (p *rawPacket) Unmarshal(packet []byte) ([]byte, error) {
+	if len(packet) == 0 {
+		return nil, fmt.Errorf("empty payload")
+	}
+	return append([]byte(nil), packet...), nil
+}
+
+func (p *rawPacket) IsPartitionHead(payload []byte) bool {
+	return true
+}
+
+func (p *rawPacket) IsPartitionTail(marker bool, payload []byte) bool {
+	return true
+}
@@ -0,0 +1,69 @@
+package audio
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupCodec(t *testing.T) {
+	require := require.New(t)
+
+	codec, err := LookupCodec("PCMA")
+	require.Nil(err)
+	require.Equal(webrtc.MimeTypePCMA, codec.Capability.MimeType)
+	codec, err = LookupCodec("audio/l16")
+	require.Nil(err)
+	require.Equal("l16", codec.Name)
+	_, err = LookupCodec("amr")
+	require.NotNil(err)
+}
+
+func TestOpusCodec(t *testing.T) {
+	require := require.New(t)
+
+	mono, err := OpusCodec(1)
+	require.Nil(err)
+	require.Equal("minptime=10;useinbandfec=1", mono.Capability.SDPFmtpLine)
+	// SDP always describes Opus as two channels
+	require.EqualValues(2, mono.Capability.Channels)
+
+	stereo, err := OpusCodec(2)
+	require.Nil(err)
+	require.Equal(webrtc.MimeTypeOpus, stereo.Capability.MimeType)
+	require.Equal("minptime=10;useinbandfec=1;stereo=1;sprop-stereo=1", stereo.Capability.SDPFmtpLine)
+
+	surround, err := OpusCodec(6)
+	require.Nil(err)
+	require.Equal(MimeTypeMultiOpus, surround.Capability.MimeType)
+	require.EqualValues(6, surround.Capability.Channels)
+	require.Equal("channel_mapping=0,4,1,2,3,5;num_streams=4;coupled_streams=2;minptime=10;useinbandfec=1", surround.Capability.SDPFmtpLine)
+	surround, err = OpusCodec(8)
+	require.Nil(err)
+	require.Equal("channel_mapping=0,6,1,2,3,4,5,7;num_streams=5;coupled_streams=3;minptime=10;useinbandfec=1", surround.Capability.SDPFmtpLine)
+
+	_, err = OpusCodec(0)
+	require.NotNil(err)
+	_, err = OpusCodec(9)
+	require.NotNil(err)
+}
+
+func TestNewCodecRTP(t *testing.T) {
+	require := require.New(t)
+
+	pcmu, err := NewCodecRTP(0, PCMU, "mic", "mic")
+	require.Nil(err)
+	defer pcmu.listener.Close()
+	require.IsType(&webrtc.TrackLocalStaticSample{}, pcmu.Track)
+
+	// pion cannot packetize L16, so its packets are forwarded as they are
+	l16, err := NewCodecRTP(0, L16, "mic", "mic")
+	require.Nil(err)
+	defer l16.listener.Close()
+	require.IsType(&webrtc.TrackLocalStaticRTP{}, l16.Track)
+
+	payload, err := (&rawPacket{}).Unmarshal([]byte{1, 2, 3})
+	require.Nil(err)
+	require.Equal([]byte{1, 2, 3}, payload)
+}
@@ -0,0 +1,107 @@
+package audio
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// resetDistance is how far a sequence number may jump before we treat the
+// packet as the start of a new stream
+const resetDistance = 3000
+
+// maxConcealed is the longest gap, in packets, that Pop reports as lost. Past
+// that we skip ahead to the next packet we hold rather than conceal the gap
+const maxConcealed = 5
+
+// JitterBuffer puts RTP packets back in order and holds a few of them back to
+// absorb variation in when they arrive
+type JitterBuffer struct {
+	mutex   sync.Mutex
+	depth   int
+	packets map[uint16]*rtp.Packet
+	next    uint16
+	started bool
+}
+
+// NewJitterBuffer creates a buffer that releases packets once depth of them are held
+func NewJitterBuffer(depth int) *JitterBuffer {
+	if depth < 1 {
+		depth = 1
+	}
+	return &JitterBuffer{
+		depth:   depth,
+		packets: make(map[uint16]*rtp.Packet),
+	}
+}
+
+// seqBefore reports whether a comes before b, allowing for wrap-around
+func seqBefore(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// Push adds a packet. Duplicates and packets that arrive after their turn are dropped.
+func (j *JitterBuffer) Push(packet *rtp.Packet) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	seq := packet.SequenceNumber
+	if j.started {
+		distance := int16(seq - j.next)
+		if distance > resetDistance || distance < -resetDistance {
+			// The sender restarted
+			j.packets = make(map[uint16]*rtp.Packet)
+			j.started = false
+		} else if distance < 0 {
+			return
+		}
+	}
+	j.packets[seq] = packet
+}
+
+// Pop returns the next packet in order. When that packet never arrived, it
+// returns lost=true so the caller can conceal the gap. Gaps longer than
+// maxConcealed are skipped instead. ok is false while too few packets are held.
+func (j *JitterBuffer) Pop() (packet *rtp.Packet, lost bool, ok bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if len(j.packets) < j.depth {
+		return nil, false, false
+	}
+	if !j.started {
+		j.next = j.earliest()
+		j.started = true
+	}
+	packet, found := j.packets[j.next]
+	if !found {
+		if earliest := j.earliest(); earliest-j.next > maxConcealed {
+			j.next = earliest
+			packet, found = j.packets[j.next], true
+		}
+	}
+	delete(j.packets, j.next)
+	j.next++
+	if !found {
+		return nil, true, true
+	}
+	return packet, false, true
+}
+
+// earliest returns the first sequence number held
+func (j *JitterBuffer) earliest() uint16 {
+	first := true
+	var earliest uint16
+	for seq := range j.packets {
+		if first || seqBefore(seq, earliest) {
+			earliest = seq
+			first = false
+		}
+	}
+	return earliest
+}
+
+// Len returns the number of packets held
+func (j *JitterBuffer) Len() int {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return len(j.packets)
+}
@@ -0,0 +1,83 @@
+package audio
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/require"
+)
+
+func packetWithSeq(seq uint16) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{SequenceNumber: seq}, Payload: []byte{byte(seq)}}
+}
+
+func TestJitterBuffer(t *testing.T) {
+	require := require.New(t)
+
+	j := NewJitterBuffer(3)
+	// Out of order across the wrap-around
+	j.Push(packetWithSeq(65535))
+	j.Push(packetWithSeq(1))
+	_, _, ok := j.Pop()
+	require.False(ok)
+	j.Push(packetWithSeq(0))
+
+	packet, lost, ok := j.Pop()
+	require.True(ok)
+	require.False(lost)
+	require.Equal(uint16(65535), packet.SequenceNumber)
+
+	// Below depth again until more packets arrive
+	_, _, ok = j.Pop()
+	require.False(ok)
+	j.Push(packetWithSeq(3))
+	packet, _, ok = j.Pop()
+	require.True(ok)
+	require.Equal(uint16(0), packet.SequenceNumber)
+
+	// Packet 2 is missing
+	j.Push(packetWithSeq(4))
+	j.Push(packetWithSeq(5))
+	packet, _, _ = j.Pop()
+	require.Equal(uint16(1), packet.SequenceNumber)
+	packet, lost, ok = j.Pop()
+	require.True(ok)
+	require.True(lost)
+	require.Nil(packet)
+
+	// Too late and duplicate packets are dropped
+	j.Push(packetWithSeq(2))
+	j.Push(packetWithSeq(4))
+	require.Equal(3, j.Len())
+
+	// A sender restart starts over
+	j.Push(packetWithSeq(40000))
+	require.Equal(1, j.Len())
+}
+
+func TestJitterBufferLongGap(t *testing.T) {
+	require := require.New(t)
+
+	j := NewJitterBuffer(1)
+	j.Push(packetWithSeq(10))
+	packet, _, _ := j.Pop()
+	require.Equal(uint16(10), packet.SequenceNumber)
+
+	// A short gap is concealed packet by packet
+	j.Push(packetWithSeq(13))
+	for i := 0; i < 2; i++ {
+		_, lost, ok := j.Pop()
+		require.True(ok)
+		require.True(lost)
+	}
+	packet, lost, _ := j.Pop()
+	require.False(lost)
+	require.Equal(uint16(13), packet.SequenceNumber)
+
+	// A long one is skipped
+	j.Push(packetWithSeq(2900))
+	packet, lost, ok := j.Pop()
+	require.True(ok)
+	require.False(lost)
+	require.Equal(uint16(2900), packet.SequenceNumber)
+}
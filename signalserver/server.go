@@ -0,0 +1,398 @@
+// Package signalserver implements a signaling server that speaks the same
+// protocol as the central server ServerConn connects to.
+package signalserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	p2p "github.com/gurupras/dhwani_backend_p2p"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sendQueueSize = 64
+	writeTimeout  = 10 * time.Second
+	// Clients are pinged every pingInterval. One we heard nothing from, not
+	// even a pong, for readTimeout is gone, e.g. behind a half-open socket
+	pingInterval = 15 * time.Second
+	readTimeout  = 3 * pingInterval
+)
+
+type client struct {
+	id      string
+	rooms   map[string]struct{}
+	conn    *websocket.Conn
+	send    chan []byte
+	done    chan struct{}
+	closing sync.Once
+}
+
+func (c *client) close() {
+	c.closing.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// enqueue hands b to the client's writer. Slow clients are disconnected
+// rather than allowed to stall the sender.
+func (c *client) enqueue(b []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- b:
+		return true
+	default:
+		log.Warnf("Send queue of '%v' is full. Disconnecting\n", c.id)
+		c.close()
+		return false
+	}
+}
+
+func (c *client) writeLoop(pingInterval time.Duration) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				log.Debugf("Failed to ping '%v': %v\n", c.id, err)
+				c.close()
+				return
+			}
+		case b := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, b); err != nil {
+				log.Debugf("Failed to write to '%v': %v\n", c.id, err)
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// Server routes signal messages between websocket clients registered by ID
+// and tracks which clients are in which rooms
+type Server struct {
+	upgrader websocket.Upgrader
+	clients  map[string]*client
+	rooms    map[string]map[string]*client
+	mutex    sync.Mutex
+	wg       sync.WaitGroup
+	closed   bool
+	// pingInterval and readTimeout are variables for tests
+	pingInterval time.Duration
+	readTimeout  time.Duration
+}
+
+// New creates a Server. Mount it on the path clients dial (usually /ws).
+func New() *Server {
+	return &Server{
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		clients:      make(map[string]*client),
+		rooms:        make(map[string]map[string]*client),
+		pingInterval: pingInterval,
+		readTimeout:  readTimeout,
+	}
+}
+
+// Clients returns the IDs of all connected clients
+func (s *Server) Clients() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ids := make([]string, 0, len(s.clients))
+	for id := range s.clients {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (s *Server) register(c *client) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return fmt.Errorf("server is closed")
+	}
+	if _, ok := s.clients[c.id]; ok {
+		return fmt.Errorf("id '%v' is already connected", c.id)
+	}
+	s.clients[c.id] = c
+	return nil
+}
+
+func (s *Server) unregister(c *client) {
+	s.mutex.Lock()
+	if s.clients[c.id] == c {
+		delete(s.clients, c.id)
+	}
+	rooms := make([]string, 0, len(c.rooms))
+	for room := range c.rooms {
+		rooms = append(rooms, room)
+	}
+	s.mutex.Unlock()
+	for _, room := range rooms {
+		s.leave(c, room)
+	}
+}
+
+func (s *Server) lookup(id string) (*client, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c, ok := s.clients[id]
+	return c, ok
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing 'id'", http.StatusBadRequest)
+		return
+	}
+	if _, ok := s.lookup(id); ok {
+		http.Error(w, fmt.Sprintf("id '%v' is already connected", id), http.StatusConflict)
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Errorf("Failed to upgrade connection of '%v': %v\n", id, err)
+		return
+	}
+	c := &client{
+		id:    id,
+		rooms: make(map[string]struct{}),
+		conn:  conn,
+		send:  make(chan []byte, sendQueueSize),
+		done:  make(chan struct{}),
+	}
+	// Another client may have registered the same ID while we were upgrading
+	if err := s.register(c); err != nil {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()))
+		conn.Close()
+		return
+	}
+	s.wg.Add(1)
+	defer s.wg.Done()
+	log.Infof("Client '%v' connected\n", id)
+	defer log.Infof("Client '%v' disconnected\n", id)
+	defer s.unregister(c)
+	defer c.close()
+
+	go c.writeLoop(s.pingInterval)
+	s.readLoop(c)
+}
+
+func (s *Server) readLoop(c *client) {
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(s.readTimeout))
+	})
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(s.readTimeout))
+		_, raw, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var env p2p.Envelope
+		if err := json.Unmarshal(raw, &env); err != nil {
+			s.sendError(c, "", "", fmt.Sprintf("bad message: %v", err))
+			continue
+		}
+		switch env.Action {
+		case p2p.ActionSignal:
+			s.handleSignal(c, raw)
+		case p2p.ActionJoin, p2p.ActionLeave, p2p.ActionListRoom:
+			s.handleRoom(c, raw)
+		case p2p.ActionPing:
+			s.handlePing(c, raw)
+		default:
+			s.sendError(c, "", "", fmt.Sprintf("unknown action '%v'", env.Action))
+		}
+	}
+}
+
+func (s *Server) handleSignal(c *client, raw []byte) {
+	var msg p2p.SignalMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		s.sendError(c, "", "", fmt.Sprintf("bad signal: %v", err))
+		return
+	}
+	// Clients cannot speak on behalf of anyone else
+	msg.From = c.id
+	target, ok := s.lookup(msg.To)
+	if !ok {
+		s.sendError(c, msg.ID, msg.To, "peer offline")
+		return
+	}
+	b, _ := json.Marshal(msg)
+	if !target.enqueue(b) {
+		s.sendError(c, msg.ID, msg.To, "peer unreachable")
+		return
+	}
+	s.sendAck(c, msg.ID)
+}
+
+func (s *Server) handlePing(c *client, raw []byte) {
+	var msg p2p.PingMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		s.sendError(c, "", "", fmt.Sprintf("bad ping: %v", err))
+		return
+	}
+	b, _ := json.Marshal(p2p.PingMessage{
+		Action: p2p.ActionPong,
+		ID:     msg.ID,
+	})
+	c.enqueue(b)
+}
+
+func (s *Server) handleRoom(c *client, raw []byte) {
+	var msg p2p.RoomMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		s.sendError(c, "", "", fmt.Sprintf("bad room message: %v", err))
+		return
+	}
+	if msg.Room == "" {
+		s.sendError(c, msg.ID, "", "missing 'room'")
+		return
+	}
+	switch msg.Action {
+	case p2p.ActionJoin:
+		members := s.join(c, msg.Room)
+		s.sendMembers(c, msg.ID, msg.Room, members)
+	case p2p.ActionLeave:
+		s.leave(c, msg.Room)
+		s.sendAck(c, msg.ID)
+	case p2p.ActionListRoom:
+		s.sendMembers(c, msg.ID, msg.Room, s.members(msg.Room, c.id))
+	}
+}
+
+// members returns the IDs in room other than exclude
+func (s *Server) members(room string, exclude string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	members := make([]string, 0, len(s.rooms[room]))
+	for id := range s.rooms[room] {
+		if id != exclude {
+			members = append(members, id)
+		}
+	}
+	return members
+}
+
+// join adds c to room, announces it to the other members and returns them
+func (s *Server) join(c *client, room string) []string {
+	s.mutex.Lock()
+	clients, ok := s.rooms[room]
+	if !ok {
+		clients = make(map[string]*client)
+		s.rooms[room] = clients
+	}
+	_, alreadyJoined := clients[c.id]
+	clients[c.id] = c
+	c.rooms[room] = struct{}{}
+	others := make([]*client, 0, len(clients))
+	for id, other := range clients {
+		if id != c.id {
+			others = append(others, other)
+		}
+	}
+	s.mutex.Unlock()
+
+	members := make([]string, 0, len(others))
+	for _, other := range others {
+		members = append(members, other.id)
+	}
+	if !alreadyJoined {
+		s.broadcastPresence(others, p2p.ActionPeerJoined, room, c.id)
+	}
+	return members
+}
+
+// leave removes c from room and announces it to the remaining members
+func (s *Server) leave(c *client, room string) {
+	s.mutex.Lock()
+	clients, ok := s.rooms[room]
+	if !ok || clients[c.id] != c {
+		s.mutex.Unlock()
+		return
+	}
+	delete(clients, c.id)
+	delete(c.rooms, room)
+	if len(clients) == 0 {
+		delete(s.rooms, room)
+	}
+	others := make([]*client, 0, len(clients))
+	for _, other := range clients {
+		others = append(others, other)
+	}
+	s.mutex.Unlock()
+	s.broadcastPresence(others, p2p.ActionPeerLeft, room, c.id)
+}
+
+func (s *Server) broadcastPresence(clients []*client, action string, room string, peer string) {
+	b, _ := json.Marshal(p2p.PresenceMessage{
+		Action: action,
+		Room:   room,
+		Peer:   peer,
+	})
+	for _, c := range clients {
+		c.enqueue(b)
+	}
+}
+
+func (s *Server) sendMembers(c *client, id string, room string, members []string) {
+	b, _ := json.Marshal(p2p.RoomMembersMessage{
+		Action:  p2p.ActionRoomMembers,
+		ID:      id,
+		Room:    room,
+		Members: members,
+	})
+	c.enqueue(b)
+}
+
+func (s *Server) sendAck(c *client, id string) {
+	if id == "" {
+		return
+	}
+	b, _ := json.Marshal(p2p.AckMessage{
+		Action: p2p.ActionAck,
+		ID:     id,
+	})
+	c.enqueue(b)
+}
+
+func (s *Server) sendError(c *client, id string, to string, reason string) {
+	b, _ := json.Marshal(p2p.ErrorMessage{
+		Action: p2p.ActionError,
+		ID:     id,
+		Error:  reason,
+		To:     to,
+	})
+	c.enqueue(b)
+}
+
+// Close disconnects every client and waits for their handlers to return
+func (s *Server) Close() {
+	s.mutex.Lock()
+	s.closed = true
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mutex.Unlock()
+	for _, c := range clients {
+		c.close()
+	}
+	s.wg.Wait()
+}
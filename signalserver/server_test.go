@@ -0,0 +1,271 @@
+package signalserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	p2p "github.com/gurupras/dhwani_backend_p2p"
+	"github.com/gurupras/dhwani_backend_p2p/e2e"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T) (*Server, string) {
+	server := New()
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(func() {
+		server.Close()
+		httpServer.Close()
+	})
+	return server, "ws" + strings.TrimPrefix(httpServer.URL, "http")
+}
+
+func connect(t *testing.T, url string, id string) *p2p.ServerConn {
+	conn, err := p2p.NewServerConnectionWithOptions(id, p2p.ServerOptions{URL: url, DialTimeout: time.Second, Acks: true})
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+func waitForClients(t *testing.T, server *Server, count int) {
+	require.Eventually(t, func() bool {
+		return len(server.Clients()) == count
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestRouteSignal(t *testing.T) {
+	require := require.New(t)
+	server, url := startServer(t)
+
+	alice := connect(t, url, "alice")
+	bob := connect(t, url, "bob")
+	waitForClients(t, server, 2)
+
+	got := make(chan p2p.SignalPacket, 1)
+	bob.OnSignal(func(sp p2p.SignalPacket) {
+		got <- sp
+	})
+	go bob.Loop()
+
+	// The server must not trust the 'from' field
+	b, _ := json.Marshal(p2p.SignalMessage{
+		Action:       p2p.ActionSignal,
+		SignalPacket: p2p.SignalPacket{From: "mallory", To: "bob", Type: "offer", Data: "abc"},
+	})
+	require.Nil(alice.WriteMessage(websocket.TextMessage, b))
+
+	select {
+	case sp := <-got:
+		require.Equal(p2p.SignalPacket{From: "alice", To: "bob", Type: "offer", Data: "abc"}, sp)
+	case <-time.After(2 * time.Second):
+		require.Fail("timed out waiting for signal")
+	}
+}
+
+func TestUnknownTarget(t *testing.T) {
+	require := require.New(t)
+	server, url := startServer(t)
+
+	alice := connect(t, url, "alice")
+	waitForClients(t, server, 1)
+
+	got := make(chan p2p.ErrorMessage, 1)
+	alice.OnAction(p2p.ActionError, func(raw json.RawMessage) error {
+		var msg p2p.ErrorMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			return err
+		}
+		got <- msg
+		return nil
+	})
+	go alice.Loop()
+
+	b, _ := json.Marshal(p2p.SignalMessage{
+		Action:       p2p.ActionSignal,
+		SignalPacket: p2p.SignalPacket{To: "nobody", Type: "offer"},
+	})
+	require.Nil(alice.WriteMessage(websocket.TextMessage, b))
+
+	select {
+	case msg := <-got:
+		require.Equal("nobody", msg.To)
+		require.NotEmpty(msg.Error)
+	case <-time.After(2 * time.Second):
+		require.Fail("timed out waiting for error")
+	}
+}
+
+func TestHalfOpenClient(t *testing.T) {
+	require := require.New(t)
+	server := New()
+	server.pingInterval = 20 * time.Millisecond
+	server.readTimeout = 100 * time.Millisecond
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+
+	// Clients that read answer pings and stay connected
+	alice := connect(t, url, "alice")
+	go alice.Loop()
+	// A client that never reads never answers them either, as if its socket were half-open
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?id=bob", nil)
+	require.Nil(err)
+	defer conn.Close()
+	waitForClients(t, server, 2)
+
+	time.Sleep(300 * time.Millisecond)
+	require.Equal([]string{"alice"}, server.Clients())
+	connect(t, url, "bob")
+	waitForClients(t, server, 2)
+}
+
+func TestDuplicateAndDisconnect(t *testing.T) {
+	require := require.New(t)
+	server, url := startServer(t)
+
+	alice := connect(t, url, "alice")
+	waitForClients(t, server, 1)
+
+	_, err := p2p.NewServerConnectionWithOptions("alice", p2p.ServerOptions{URL: url, DialTimeout: time.Second})
+	require.NotNil(err)
+
+	alice.Close()
+	waitForClients(t, server, 0)
+
+	connect(t, url, "alice")
+	waitForClients(t, server, 1)
+}
+
+func TestSendSignal(t *testing.T) {
+	require := require.New(t)
+	server, url := startServer(t)
+
+	alice := connect(t, url, "alice")
+	bob := connect(t, url, "bob")
+	waitForClients(t, server, 2)
+	go alice.Loop()
+	got := make(chan p2p.SignalPacket, 1)
+	bob.OnSignal(func(sp p2p.SignalPacket) {
+		got <- sp
+	})
+	go bob.Loop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := alice.SendSignal(ctx, p2p.SignalPacket{To: "bob", Type: "offer", Data: "abc"})
+	require.Nil(err)
+	require.Equal(p2p.SignalPacket{From: "alice", To: "bob", Type: "offer", Data: "abc"}, <-got)
+
+	err = alice.SendSignal(ctx, p2p.SignalPacket{To: "carol", Type: "offer", Data: "abc"})
+	var sigErr *p2p.SignalError
+	require.True(errors.As(err, &sigErr))
+	require.Equal("carol", sigErr.To)
+	require.Equal("peer offline", sigErr.Reason)
+}
+
+func TestRooms(t *testing.T) {
+	require := require.New(t)
+	server, url := startServer(t)
+
+	alice := connect(t, url, "alice")
+	bob := connect(t, url, "bob")
+	waitForClients(t, server, 2)
+
+	joined := make(chan p2p.PresenceEvent, 1)
+	left := make(chan p2p.PresenceEvent, 1)
+	alice.OnPeerJoined(func(ev p2p.PresenceEvent) {
+		joined <- ev
+	})
+	alice.OnPeerLeft(func(ev p2p.PresenceEvent) {
+		left <- ev
+	})
+	go alice.Loop()
+	go bob.Loop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	members, err := alice.JoinRoom(ctx, "studio")
+	require.Nil(err)
+	require.Empty(members)
+	require.Equal([]string{"studio"}, alice.Rooms())
+
+	members, err = bob.JoinRoom(ctx, "studio")
+	require.Nil(err)
+	require.Equal([]string{"alice"}, members)
+	require.Equal(p2p.PresenceEvent{Room: "studio", Peer: "bob"}, <-joined)
+
+	members, err = alice.ListRoom(ctx, "studio")
+	require.Nil(err)
+	require.Equal([]string{"bob"}, members)
+
+	require.Nil(bob.LeaveRoom(ctx, "studio"))
+	require.Equal(p2p.PresenceEvent{Room: "studio", Peer: "bob"}, <-left)
+
+	_, err = bob.JoinRoom(ctx, "studio")
+	require.Nil(err)
+	<-joined
+	bob.Close()
+	require.Equal(p2p.PresenceEvent{Room: "studio", Peer: "bob"}, <-left)
+
+	members, err = alice.ListRoom(ctx, "other")
+	require.Nil(err)
+	require.Empty(members)
+}
+
+func TestPing(t *testing.T) {
+	_, url := startServer(t)
+
+	conn, err := p2p.NewServerConnectionWithOptions("alice", p2p.ServerOptions{
+		URL:               url,
+		DialTimeout:       time.Second,
+		HeartbeatInterval: 10 * time.Millisecond,
+	})
+	require.Nil(t, err)
+	defer conn.Close()
+	go conn.Loop()
+
+	require.Eventually(t, func() bool {
+		return conn.RTT() > 0
+	}, 2*time.Second, 5*time.Millisecond)
+}
+
+func TestSealedSignal(t *testing.T) {
+	require := require.New(t)
+	server, url := startServer(t)
+
+	aliceKeys, err := e2e.GenerateKeyPair()
+	require.Nil(err)
+	bobKeys, err := e2e.GenerateKeyPair()
+	require.Nil(err)
+	aliceRing := e2e.NewMemoryKeyring()
+	aliceRing.Pin("bob", bobKeys.Public)
+	bobRing := e2e.NewMemoryKeyring()
+	bobRing.Pin("alice", aliceKeys.Public)
+
+	alice := connect(t, url, "alice")
+	alice.SetSealer(e2e.NewSealer(aliceKeys, aliceRing, e2e.Options{}))
+	bob := connect(t, url, "bob")
+	bob.SetSealer(e2e.NewSealer(bobKeys, bobRing, e2e.Options{}))
+	waitForClients(t, server, 2)
+
+	got := make(chan p2p.SignalPacket, 1)
+	bob.OnSignal(func(sp p2p.SignalPacket) {
+		got <- sp
+	})
+	go alice.Loop()
+	go bob.Loop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.Nil(alice.SendSignal(ctx, p2p.SignalPacket{To: "bob", Type: "offer", Data: "abc"}))
+	require.Equal(p2p.SignalPacket{From: "alice", To: "bob", Type: "offer", Data: "abc"}, <-got)
+}
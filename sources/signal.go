@@ -0,0 +1,89 @@
+package sources
+
+import (
+	"context"
+	"errors"
+
+	p2p "github.com/gurupras/dhwani_backend_p2p"
+	"github.com/gurupras/dhwani_backend_p2p/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+// Signal types for listing and subscribing to sources
+const (
+	SignalListSources = "list-sources"
+	SignalSubscribe   = "subscribe"
+	SignalSources     = "sources"
+)
+
+// SubscribeMessage is the data of a subscribe signal
+type SubscribeMessage struct {
+	Sources []string `json:"sources"`
+}
+
+// SourcesMessage is the data of a sources signal, sent in reply to both
+// list-sources and subscribe
+type SourcesMessage struct {
+	Sources    []Info   `json:"sources"`
+	Subscribed []string `json:"subscribed"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// ErrNotConnected is the error peers get for asking before they have a session
+var ErrNotConnected = errors.New("not connected")
+
+// Serve answers list-sources and subscribe signals from remote peers that
+// connected reports as having a session, which they only get once admitted.
+// onSubscribe is called after a peer's subscription changed.
+// It returns a function that stops serving.
+func Serve(conn *p2p.ServerConn, m *Manager, connected func(remoteID string) bool, onSubscribe func(remoteID string)) func() {
+	return conn.OnSignal(func(sp p2p.SignalPacket) {
+		reply := SourcesMessage{}
+		switch sp.Type {
+		case SignalListSources, SignalSubscribe:
+		default:
+			return
+		}
+		if !connected(sp.From) {
+			// Nor do we keep a subscription for them, which only Forget would remove
+			reply.Error = ErrNotConnected.Error()
+			send(conn, sp.From, reply)
+			return
+		}
+		switch sp.Type {
+		case SignalSubscribe:
+			msg := SubscribeMessage{}
+			err := peer.DecodeJSON(sp.Data, &msg)
+			if err == nil {
+				err = m.Subscribe(sp.From, msg.Sources)
+			}
+			if err != nil {
+				reply.Error = err.Error()
+			} else if onSubscribe != nil {
+				onSubscribe(sp.From)
+			}
+		}
+		reply.Sources = m.Sources()
+		for i := range reply.Sources {
+			// Local devices and ports are none of a remote peer's business
+			reply.Sources[i].Device = ""
+			reply.Sources[i].Port = 0
+		}
+		reply.Subscribed = m.Subscription(sp.From)
+		send(conn, sp.From, reply)
+	})
+}
+
+func send(conn *p2p.ServerConn, to string, reply SourcesMessage) {
+	data, err := peer.EncodeJSON(reply)
+	if err != nil {
+		log.Errorf("Failed to encode sources: %v\n", err)
+		return
+	}
+	// We are on the connection's loop, which is what reads the ack
+	go func() {
+		if err := conn.SendSignal(context.Background(), p2p.SignalPacket{To: to, Type: SignalSources, Data: data}); err != nil {
+			log.Errorf("Failed to send sources to '%v': %v\n", to, err)
+		}
+	}()
+}
@@ -0,0 +1,566 @@
+// Package sources manages the named audio sources media-peer publishes. Each
+// source has its own recorder, RTP ingest and track.
+package sources
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gurupras/dhwani_backend_p2p/record"
+	"github.com/gurupras/dhwani_backend_p2p/rtp/audio"
+	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Info describes a source to remote peers
+type Info struct {
+	Name      string `json:"name"`
+	Device    string `json:"device,omitempty"`
+	Port      int    `json:"port,omitempty"`
+	Channels  int    `json:"channels"`
+	TrackID   string `json:"track"`
+	Recording bool   `json:"recording"`
+	// Tiers lists the bitrates the source is encoded at, if it has quality tiers
+	Tiers []int `json:"tiers,omitempty"`
+	// Codecs lists the MIME types the source is encoded as, if there is more than Opus
+	Codecs []string `json:"codecs,omitempty"`
+}
+
+// TrackSwap is a track a peer should switch to another one
+type TrackSwap struct {
+	Old, New webrtc.TrackLocal
+}
+
+// TrackCallback is told when a source's track appears, is replaced or goes away.
+// old is nil for a new source and track is nil for a removed one.
+type TrackCallback func(name string, old, track webrtc.TrackLocal)
+
+// encoding is an additional encoding of a source with its own RTP ingest:
+// either a lower quality Opus tier or another codec
+type encoding struct {
+	codec    audio.Codec
+	bitrate  int
+	channels int
+	rtp      *audio.AudioRTP
+}
+
+type source struct {
+	name     string
+	device   string
+	channels int
+	// rtp carries the best encoding
+	rtp      *audio.AudioRTP
+	recorder record.Recorder
+	// bitrate of rtp, if the source has tiers
+	bitrate int
+	// tiers are ordered by ascending bitrate and exist while recording
+	tiers []encoding
+	// encodings in codecs other than Opus exist while recording
+	encodings []encoding
+}
+
+func (s *source) info() Info {
+	info := Info{
+		Name:      s.name,
+		Device:    s.device,
+		Port:      s.rtp.Port,
+		Channels:  s.channels,
+		TrackID:   s.rtp.Track.ID(),
+		Recording: s.recorder != nil,
+	}
+	for _, t := range s.tiers {
+		info.Tiers = append(info.Tiers, t.bitrate)
+	}
+	if len(s.tiers) > 0 {
+		info.Tiers = append(info.Tiers, s.bitrate)
+	}
+	if len(s.encodings) > 0 {
+		info.Codecs = append(info.Codecs, s.rtp.Codec.Capability.MimeType)
+	}
+	for _, e := range s.encodings {
+		info.Codecs = append(info.Codecs, e.codec.Capability.MimeType)
+	}
+	return info
+}
+
+// trackFor returns the track for a peer that takes codecs, most preferred
+// first, at up to bitrate. A bitrate of 0 means no limit. Peers that take
+// none of our codecs get our best Opus.
+func (s *source) trackFor(bitrate int, codecs []string) webrtc.TrackLocal {
+	if len(codecs) == 0 {
+		// Everyone takes Opus, but not necessarily multiopus
+		codecs = []string{webrtc.MimeTypeOpus}
+	}
+	for _, codec := range codecs {
+		if strings.EqualFold(codec, s.rtp.Codec.Capability.MimeType) {
+			break
+		}
+		for _, e := range s.encodings {
+			if strings.EqualFold(codec, e.codec.Capability.MimeType) {
+				return e.rtp.Track
+			}
+		}
+	}
+	return s.opusTrack(bitrate)
+}
+
+// opusTrack returns the track of the best Opus tier that fits in bitrate
+func (s *source) opusTrack(bitrate int) webrtc.TrackLocal {
+	if bitrate == 0 || len(s.tiers) == 0 || bitrate >= s.bitrate {
+		return s.rtp.Track
+	}
+	track := s.tiers[0].rtp.Track
+	for _, t := range s.tiers {
+		if t.bitrate <= bitrate {
+			track = t.rtp.Track
+		}
+	}
+	return track
+}
+
+// extraTracks returns the tracks of the tiers and other codecs
+func (s *source) extraTracks() []webrtc.TrackLocal {
+	tracks := make([]webrtc.TrackLocal, 0, len(s.tiers)+len(s.encodings))
+	for _, e := range append(append([]encoding(nil), s.tiers...), s.encodings...) {
+		tracks = append(tracks, e.rtp.Track)
+	}
+	return tracks
+}
+
+// stopRecorder stops the recorder with its tiers and other codecs, returning their tracks
+func (s *source) stopRecorder() []webrtc.TrackLocal {
+	if s.recorder == nil {
+		return nil
+	}
+	if err := s.recorder.Stop(); err != nil {
+		log.Warnf("Failed to stop recorder of source '%v': %v\n", s.name, err)
+	}
+	s.recorder = nil
+	tracks := s.extraTracks()
+	stopEncodings(s.tiers)
+	stopEncodings(s.encodings)
+	s.tiers = nil
+	s.encodings = nil
+	return tracks
+}
+
+func stopEncodings(encodings []encoding) {
+	for _, e := range encodings {
+		e.rtp.Stop()
+	}
+}
+
+// Manager holds the set of sources and which of them each remote peer receives
+type Manager struct {
+	// NewRecorder creates the process capturing device into outputs. Defaults to record.NewTieredRecorder
+	NewRecorder func(device string, outputs []record.Output) record.Recorder
+	// Tiers, if set, are the ascending bitrates each recorder encodes at.
+	// Peers receive the best tier their estimated bitrate allows
+	Tiers []int
+	// Codecs, if set, are what each recorder encodes as besides Opus. Peers
+	// receive the first codec in their offer that a source has
+	Codecs []audio.Codec
+	// Channels of new sources. Sources with more than two channels are also
+	// encoded as stereo for peers without multiopus
+	Channels int
+
+	mutex          sync.Mutex
+	sources        map[string]*source
+	subscriptions  map[string][]string
+	bitrates       map[string]int
+	codecs         map[string][]string
+	trackCallbacks map[int]TrackCallback
+	nextCallbackID int
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		NewRecorder:    record.NewTieredRecorder,
+		Channels:       2,
+		sources:        make(map[string]*source),
+		subscriptions:  make(map[string][]string),
+		bitrates:       make(map[string]int),
+		codecs:         make(map[string][]string),
+		trackCallbacks: make(map[int]TrackCallback),
+	}
+}
+
+// OnTrackChange registers cb and returns a function that unregisters it
+func (m *Manager) OnTrackChange(cb TrackCallback) func() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	id := m.nextCallbackID
+	m.nextCallbackID++
+	m.trackCallbacks[id] = cb
+	return func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		delete(m.trackCallbacks, id)
+	}
+}
+
+func (m *Manager) notify(name string, old, track webrtc.TrackLocal) {
+	m.mutex.Lock()
+	callbacks := make([]TrackCallback, 0, len(m.trackCallbacks))
+	for _, cb := range m.trackCallbacks {
+		callbacks = append(callbacks, cb)
+	}
+	m.mutex.Unlock()
+	for _, cb := range callbacks {
+		cb(name, old, track)
+	}
+}
+
+// StartRTP (re)starts the RTP ingest of the source called name, creating the
+// source if needed. A port of 0 picks a free port. A running recorder is
+// restarted if the port changes.
+func (m *Manager) StartRTP(name string, port int) (Info, error) {
+	return m.startRTP(name, port, 0)
+}
+
+// SetChannels changes the number of channels of the source called name. Peers
+// receiving it renegotiate for the new codec.
+func (m *Manager) SetChannels(name string, channels int) (Info, error) {
+	info, ok := m.Source(name)
+	if !ok {
+		return Info{}, fmt.Errorf("no source '%v'", name)
+	}
+	return m.startRTP(name, info.Port, channels)
+}
+
+// startRTP is StartRTP with a channel count. 0 keeps that of an existing
+// source and means Channels for a new one.
+func (m *Manager) startRTP(name string, port int, channels int) (Info, error) {
+	if name == "" {
+		return Info{}, fmt.Errorf("source must have a name")
+	}
+	// Restarting on the same port needs the port released first
+	m.mutex.Lock()
+	var released *audio.AudioRTP
+	if s, ok := m.sources[name]; ok {
+		if port != 0 && s.rtp.Port == port {
+			released = s.rtp
+		}
+		if channels == 0 {
+			channels = s.channels
+		}
+	}
+	if channels == 0 {
+		channels = m.Channels
+	}
+	m.mutex.Unlock()
+	codec, err := audio.OpusCodec(channels)
+	if err != nil {
+		return Info{}, fmt.Errorf("source '%v': %w", name, err)
+	}
+	if released != nil {
+		released.Stop()
+	}
+
+	rtp, err := audio.NewCodecRTP(port, codec, name, name)
+	if err != nil {
+		if released != nil {
+			m.Remove(name)
+		}
+		return Info{}, fmt.Errorf("failed to start RTP for source '%v': %w", name, err)
+	}
+	go rtp.Loop()
+
+	m.mutex.Lock()
+	s, ok := m.sources[name]
+	if !ok {
+		s = &source{name: name}
+		m.sources[name] = s
+	}
+	previous := s.rtp
+	s.rtp = rtp
+	s.channels = channels
+	codecChanged := previous != nil && !sameCodec(previous.Codec, codec)
+	var restartErr error
+	var swaps []TrackSwap
+	if s.recorder != nil && (previous == nil || previous.Port != rtp.Port || codecChanged) {
+		swaps, restartErr = m.restartRecorderLocked(s, s.device)
+	}
+	info := s.info()
+	m.mutex.Unlock()
+
+	var old webrtc.TrackLocal
+	if previous != nil {
+		if previous != released {
+			previous.Stop()
+		}
+		old = previous.Track
+	}
+	if codecChanged {
+		// Tracks can only be swapped for tracks of the same codec. Peers have
+		// to renegotiate instead
+		for _, swap := range swaps {
+			m.notify(name, swap.Old, nil)
+		}
+		m.notify(name, old, nil)
+		m.notify(name, nil, rtp.Track)
+		return info, restartErr
+	}
+	m.notifySwaps(name, swaps)
+	m.notify(name, old, rtp.Track)
+	return info, restartErr
+}
+
+func sameCodec(a, b audio.Codec) bool {
+	return a.Capability.MimeType == b.Capability.MimeType && a.Capability.SDPFmtpLine == b.Capability.SDPFmtpLine
+}
+
+// StartRecorder (re)starts capturing device into the source called name
+func (m *Manager) StartRecorder(name string, device string) error {
+	m.mutex.Lock()
+	s, ok := m.sources[name]
+	if !ok {
+		m.mutex.Unlock()
+		return fmt.Errorf("no source '%v'", name)
+	}
+	swaps, err := m.restartRecorderLocked(s, device)
+	m.mutex.Unlock()
+	m.notifySwaps(name, swaps)
+	return err
+}
+
+// restartRecorderLocked replaces the recorder of s, returning how the tracks
+// of its tiers and other codecs changed
+func (m *Manager) restartRecorderLocked(s *source, device string) ([]TrackSwap, error) {
+	old := s.stopRecorder()
+	err := m.startRecorderLocked(s, device)
+	current := s.extraTracks()
+	swaps := make([]TrackSwap, 0, len(old))
+	for i, track := range old {
+		swap := TrackSwap{Old: track}
+		if i < len(current) {
+			swap.New = current[i]
+		}
+		swaps = append(swaps, swap)
+	}
+	return swaps, err
+}
+
+func (m *Manager) startRecorderLocked(s *source, device string) error {
+	outputs := []record.Output{{Port: s.rtp.Port, Codec: s.rtp.Codec.Capability.MimeType, Channels: s.channels}}
+	started := make([]encoding, 0, len(m.Tiers)+len(m.Codecs)+1)
+	start := func(e encoding) error {
+		rtp, err := audio.NewCodecRTP(0, e.codec, s.name, s.name)
+		if err != nil {
+			return fmt.Errorf("failed to start %v RTP for source '%v': %w", e.codec.Name, s.name, err)
+		}
+		go rtp.Loop()
+		e.rtp = rtp
+		started = append(started, e)
+		outputs = append(outputs, record.Output{Port: rtp.Port, Codec: e.codec.Capability.MimeType, Bitrate: e.bitrate, Channels: e.channels})
+		return nil
+	}
+	if len(m.Tiers) > 0 {
+		for _, bitrate := range m.Tiers[:len(m.Tiers)-1] {
+			if err := start(encoding{codec: s.rtp.Codec, bitrate: bitrate, channels: s.channels}); err != nil {
+				stopEncodings(started)
+				return err
+			}
+		}
+		outputs[0].Bitrate = m.Tiers[len(m.Tiers)-1]
+	}
+	tiers := len(started)
+	if s.channels > 2 {
+		stereo, _ := audio.OpusCodec(2)
+		if err := start(encoding{codec: stereo, channels: 2}); err != nil {
+			stopEncodings(started)
+			return err
+		}
+	}
+	for _, codec := range m.Codecs {
+		if err := start(encoding{codec: codec}); err != nil {
+			stopEncodings(started)
+			return err
+		}
+	}
+	recorder := m.NewRecorder(device, outputs)
+	if err := recorder.Start(); err != nil {
+		stopEncodings(started)
+		return fmt.Errorf("failed to start recorder for source '%v': %w", s.name, err)
+	}
+	s.device = device
+	s.recorder = recorder
+	s.bitrate = outputs[0].Bitrate
+	s.tiers = started[:tiers]
+	s.encodings = started[tiers:]
+	return nil
+}
+
+// notifySwaps tells the track callbacks about tiers and codecs that were replaced or went away
+func (m *Manager) notifySwaps(name string, swaps []TrackSwap) {
+	for _, swap := range swaps {
+		m.notify(name, swap.Old, swap.New)
+	}
+}
+
+// Add creates a source capturing channels of device on a free port. 0 channels means Channels
+func (m *Manager) Add(name string, device string, channels int) (Info, error) {
+	if _, ok := m.Source(name); ok {
+		return Info{}, fmt.Errorf("source '%v' already exists", name)
+	}
+	if _, err := m.startRTP(name, 0, channels); err != nil {
+		return Info{}, err
+	}
+	if err := m.StartRecorder(name, device); err != nil {
+		m.Remove(name)
+		return Info{}, err
+	}
+	info, _ := m.Source(name)
+	return info, nil
+}
+
+// Remove stops the source called name
+func (m *Manager) Remove(name string) error {
+	m.mutex.Lock()
+	s, ok := m.sources[name]
+	if ok {
+		delete(m.sources, name)
+		s.stopRecorder()
+	}
+	m.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("no source '%v'", name)
+	}
+	s.rtp.Stop()
+	m.notify(name, s.rtp.Track, nil)
+	return nil
+}
+
+// Source returns the source called name
+func (m *Manager) Source(name string) (Info, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s, ok := m.sources[name]
+	if !ok {
+		return Info{}, false
+	}
+	return s.info(), true
+}
+
+// Sources lists every source by name
+func (m *Manager) Sources() []Info {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	result := make([]Info, 0, len(m.sources))
+	for _, s := range m.sources {
+		result = append(result, s.info())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Subscribe limits what remoteID receives to the named sources. No names
+// means every source, which is also what peers get until they subscribe.
+func (m *Manager) Subscribe(remoteID string, names []string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, name := range names {
+		if _, ok := m.sources[name]; !ok {
+			return fmt.Errorf("no source '%v'", name)
+		}
+	}
+	if len(names) == 0 {
+		delete(m.subscriptions, remoteID)
+		return nil
+	}
+	m.subscriptions[remoteID] = append([]string(nil), names...)
+	return nil
+}
+
+// Subscription returns the sources remoteID subscribed to, or nil for all of them
+func (m *Manager) Subscription(remoteID string) []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]string(nil), m.subscriptions[remoteID]...)
+}
+
+// Tracks returns the tracks remoteID should receive
+func (m *Manager) Tracks(remoteID string) []webrtc.TrackLocal {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	bitrate, codecs := m.bitrates[remoteID], m.codecs[remoteID]
+	sources := m.receivedLocked(remoteID)
+	tracks := make([]webrtc.TrackLocal, 0, len(sources))
+	for _, s := range sources {
+		tracks = append(tracks, s.trackFor(bitrate, codecs))
+	}
+	return tracks
+}
+
+// receivedLocked returns the sources remoteID receives
+func (m *Manager) receivedLocked(remoteID string) []*source {
+	names := m.subscriptions[remoteID]
+	if len(names) == 0 {
+		for name := range m.sources {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	sources := make([]*source, 0, len(names))
+	for _, name := range names {
+		// Subscriptions may outlive the sources they name
+		if s, ok := m.sources[name]; ok {
+			sources = append(sources, s)
+		}
+	}
+	return sources
+}
+
+// SetCodecs records the codecs remoteID takes, most preferred first, which
+// decides the tracks it gets from Tracks. No codecs forgets the peer.
+func (m *Manager) SetCodecs(remoteID string, codecs []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(codecs) == 0 {
+		delete(m.codecs, remoteID)
+		return
+	}
+	m.codecs[remoteID] = append([]string(nil), codecs...)
+}
+
+// SetBitrate records the bitrate remoteID can receive, returning the tracks it
+// should switch to. A bitrate of 0 forgets the peer.
+func (m *Manager) SetBitrate(remoteID string, bitrate int) []TrackSwap {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	previous, codecs := m.bitrates[remoteID], m.codecs[remoteID]
+	if bitrate == 0 {
+		delete(m.bitrates, remoteID)
+	} else {
+		m.bitrates[remoteID] = bitrate
+	}
+	swaps := make([]TrackSwap, 0)
+	for _, s := range m.receivedLocked(remoteID) {
+		old, track := s.trackFor(previous, codecs), s.trackFor(bitrate, codecs)
+		if old != track {
+			swaps = append(swaps, TrackSwap{Old: old, New: track})
+		}
+	}
+	return swaps
+}
+
+// Forget drops the subscription, codecs and bitrate of remoteID, e.g. once
+// its session has closed
+func (m *Manager) Forget(remoteID string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.subscriptions, remoteID)
+	delete(m.codecs, remoteID)
+	delete(m.bitrates, remoteID)
+}
+
+// Close stops every source
+func (m *Manager) Close() {
+	for _, info := range m.Sources() {
+		m.Remove(info.Name)
+	}
+}
@@ -0,0 +1,365 @@
+package sources
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	p2p "github.com/gurupras/dhwani_backend_p2p"
+	"github.com/gurupras/dhwani_backend_p2p/peer"
+	"github.com/gurupras/dhwani_backend_p2p/record"
+	"github.com/gurupras/dhwani_backend_p2p/rtp/audio"
+	"github.com/gurupras/dhwani_backend_p2p/signalserver"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeRecorder struct {
+	device  string
+	port    int
+	outputs []record.Output
+	running bool
+}
+
+func (r *fakeRecorder) Start() error {
+	r.running = true
+	return nil
+}
+
+func (r *fakeRecorder) Stop() error {
+	r.running = false
+	return nil
+}
+
+func newTestManager(t *testing.T) (*Manager, *[]*fakeRecorder) {
+	recorders := make([]*fakeRecorder, 0)
+	m := NewManager()
+	m.NewRecorder = func(device string, outputs []record.Output) record.Recorder {
+		r := &fakeRecorder{device: device, port: outputs[0].Port, outputs: outputs}
+		recorders = append(recorders, r)
+		return r
+	}
+	t.Cleanup(m.Close)
+	return m, &recorders
+}
+
+func TestManager(t *testing.T) {
+	require := require.New(t)
+
+	m, recorders := newTestManager(t)
+	type change struct {
+		name       string
+		old, track webrtc.TrackLocal
+	}
+	changes := make([]change, 0)
+	m.OnTrackChange(func(name string, old, track webrtc.TrackLocal) {
+		changes = append(changes, change{name, old, track})
+	})
+
+	mic, err := m.Add("mic", "hw:0", 0)
+	require.Nil(err)
+	require.NotZero(mic.Port)
+	require.True(mic.Recording)
+	require.Equal("mic", mic.TrackID)
+	require.Len(*recorders, 1)
+	require.Equal(mic.Port, (*recorders)[0].port)
+
+	_, err = m.Add("mic", "hw:1", 0)
+	require.NotNil(err)
+	_, err = m.Add("monitor", "hw:2", 0)
+	require.Nil(err)
+	require.Len(m.Sources(), 2)
+	require.Equal("mic", m.Sources()[0].Name)
+	require.Len(m.Tracks("listener"), 2)
+
+	// Restarting the ingest on another port replaces the track and moves the recorder
+	restarted, err := m.StartRTP("mic", 0)
+	require.Nil(err)
+	require.NotEqual(mic.Port, restarted.Port)
+	require.False((*recorders)[0].running)
+	require.Equal(restarted.Port, (*recorders)[2].port)
+	require.Equal("hw:0", (*recorders)[2].device)
+	require.Len(changes, 3)
+	require.NotNil(changes[2].old)
+	require.False(changes[2].old == changes[2].track)
+
+	// Restarting on the same port works too
+	again, err := m.StartRTP("mic", restarted.Port)
+	require.Nil(err)
+	require.Equal(restarted.Port, again.Port)
+	require.Len(*recorders, 3)
+
+	require.NotNil(m.Subscribe("listener", []string{"nope"}))
+	require.Nil(m.Subscribe("listener", []string{"monitor"}))
+	tracks := m.Tracks("listener")
+	require.Len(tracks, 1)
+	require.Equal("monitor", tracks[0].ID())
+	require.Len(m.Tracks("other"), 2)
+
+	require.Nil(m.Remove("monitor"))
+	require.NotNil(m.Remove("monitor"))
+	require.Empty(m.Tracks("listener"))
+	require.Nil(changes[4].track)
+	require.Nil(m.Subscribe("listener", nil))
+	require.Len(m.Tracks("listener"), 1)
+
+	require.NotNil(m.StartRecorder("monitor", "hw:2"))
+}
+
+func TestTiers(t *testing.T) {
+	require := require.New(t)
+
+	m, recorders := newTestManager(t)
+	m.Tiers = []int{24000, 64000, 128000}
+	swapped := make([]webrtc.TrackLocal, 0)
+	m.OnTrackChange(func(name string, old, track webrtc.TrackLocal) {
+		if old != nil && track != nil {
+			swapped = append(swapped, old)
+		}
+	})
+
+	mic, err := m.Add("mic", "hw:0", 0)
+	require.Nil(err)
+	require.Equal([]int{24000, 64000, 128000}, mic.Tiers)
+	outputs := (*recorders)[0].outputs
+	require.Len(outputs, 3)
+	require.Equal(record.Output{Port: mic.Port, Codec: webrtc.MimeTypeOpus, Bitrate: 128000, Channels: 2}, outputs[0])
+	require.Equal(64000, outputs[2].Bitrate)
+
+	best := m.Tracks("listener")[0]
+	require.Empty(m.SetBitrate("listener", 200000))
+	swaps := m.SetBitrate("listener", 70000)
+	require.Len(swaps, 1)
+	require.True(swaps[0].Old == best)
+	middle := swaps[0].New
+	require.Equal("mic", middle.ID())
+	require.True(m.Tracks("listener")[0] == middle)
+	require.True(m.Tracks("other")[0] == best)
+
+	// Below the lowest tier still gets the lowest tier
+	swaps = m.SetBitrate("listener", 8000)
+	require.Len(swaps, 1)
+	require.True(swaps[0].Old == middle)
+	lowest := swaps[0].New
+
+	// Restarting the recorder replaces the tracks of the tiers
+	require.Nil(m.StartRecorder("mic", "hw:1"))
+	require.Len(swapped, 2)
+	require.True(swapped[0] == lowest)
+	require.False(m.Tracks("listener")[0] == lowest)
+
+	swaps = m.SetBitrate("listener", 0)
+	require.Len(swaps, 1)
+	require.True(swaps[0].New == best)
+}
+
+func mimeType(track webrtc.TrackLocal) string {
+	return track.(interface {
+		Codec() webrtc.RTPCodecCapability
+	}).Codec().MimeType
+}
+
+func TestCodecs(t *testing.T) {
+	require := require.New(t)
+
+	m, recorders := newTestManager(t)
+	m.Tiers = []int{24000, 128000}
+	m.Codecs = []audio.Codec{audio.PCMU, audio.L16}
+
+	mic, err := m.Add("mic", "hw:0", 0)
+	require.Nil(err)
+	require.Equal([]string{webrtc.MimeTypeOpus, webrtc.MimeTypePCMU, audio.MimeTypeL16}, mic.Codecs)
+	outputs := (*recorders)[0].outputs
+	require.Len(outputs, 4)
+	require.Equal(webrtc.MimeTypePCMU, outputs[2].Codec)
+	require.Equal(audio.MimeTypeL16, outputs[3].Codec)
+
+	opus := m.Tracks("browser")[0]
+	require.Equal(webrtc.MimeTypeOpus, mimeType(opus))
+
+	// The first of the peer's codecs that we have wins
+	m.SetCodecs("phone", []string{"audio/AMR", "audio/pcmu", webrtc.MimeTypeOpus})
+	pcmu := m.Tracks("phone")[0]
+	require.Equal(webrtc.MimeTypePCMU, mimeType(pcmu))
+	require.Equal("mic", pcmu.ID())
+	// Bitrate tiers only apply to Opus
+	require.Empty(m.SetBitrate("phone", 16000))
+
+	m.SetCodecs("studio", []string{webrtc.MimeTypeOpus, audio.MimeTypeL16})
+	require.True(m.Tracks("studio")[0] == opus)
+	m.SetCodecs("studio", []string{audio.MimeTypeL16})
+	require.Equal(audio.MimeTypeL16, mimeType(m.Tracks("studio")[0]))
+	m.SetCodecs("studio", nil)
+	require.True(m.Tracks("studio")[0] == opus)
+
+	// Restarting the recorder replaces the tracks of the other codecs too
+	swapped := make([]webrtc.TrackLocal, 0)
+	m.OnTrackChange(func(name string, old, track webrtc.TrackLocal) {
+		swapped = append(swapped, old)
+	})
+	require.Nil(m.StartRecorder("mic", "hw:1"))
+	require.Len(swapped, 3)
+	require.True(swapped[1] == pcmu)
+	require.Equal(webrtc.MimeTypePCMU, mimeType(m.Tracks("phone")[0]))
+	require.False(m.Tracks("phone")[0] == pcmu)
+}
+
+func TestForget(t *testing.T) {
+	require := require.New(t)
+
+	m, _ := newTestManager(t)
+	m.Tiers = []int{24000, 128000}
+	m.Codecs = []audio.Codec{audio.PCMU}
+	_, err := m.Add("mic", "hw:0", 0)
+	require.Nil(err)
+	_, err = m.Add("monitor", "hw:1", 0)
+	require.Nil(err)
+	opus := m.Tracks("listener")[0]
+
+	require.Nil(m.Subscribe("listener", []string{"monitor"}))
+	m.SetCodecs("listener", []string{webrtc.MimeTypePCMU})
+	m.SetBitrate("listener", 16000)
+	m.Forget("listener")
+	require.Nil(m.Subscription("listener"))
+	require.Len(m.Tracks("listener"), 2)
+	require.True(m.Tracks("listener")[0] == opus)
+}
+
+func TestChannels(t *testing.T) {
+	require := require.New(t)
+
+	m, recorders := newTestManager(t)
+	mic, err := m.Add("mic", "hw:0", 0)
+	require.Nil(err)
+	require.Equal(2, mic.Channels)
+	stereo := m.Tracks("listener")[0]
+	require.Equal(webrtc.MimeTypeOpus, mimeType(stereo))
+
+	changes := make([][2]webrtc.TrackLocal, 0)
+	m.OnTrackChange(func(name string, old, track webrtc.TrackLocal) {
+		changes = append(changes, [2]webrtc.TrackLocal{old, track})
+	})
+	mic, err = m.SetChannels("mic", 6)
+	require.Nil(err)
+	require.Equal(6, mic.Channels)
+	// Peers renegotiate rather than replace the track, since the codec changed
+	require.Len(changes, 2)
+	require.True(changes[0][0] == stereo && changes[0][1] == nil)
+	require.Nil(changes[1][0])
+
+	outputs := (*recorders)[1].outputs
+	require.Len(outputs, 2)
+	require.Equal(record.Output{Port: mic.Port, Codec: audio.MimeTypeMultiOpus, Channels: 6}, outputs[0])
+	require.Equal(record.Output{Port: outputs[1].Port, Codec: webrtc.MimeTypeOpus, Channels: 2}, outputs[1])
+
+	// Peers without multiopus get the stereo fallback
+	require.Equal(webrtc.MimeTypeOpus, mimeType(m.Tracks("listener")[0]))
+	m.SetCodecs("surround", []string{audio.MimeTypeMultiOpus, webrtc.MimeTypeOpus})
+	require.True(m.Tracks("surround")[0] == changes[1][1])
+
+	_, err = m.SetChannels("mic", 9)
+	require.NotNil(err)
+	_, err = m.SetChannels("monitor", 2)
+	require.NotNil(err)
+}
+
+func TestServe(t *testing.T) {
+	require := require.New(t)
+
+	server := signalserver.New()
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+
+	m, _ := newTestManager(t)
+	_, err := m.Add("mic", "hw:0", 0)
+	require.Nil(err)
+	_, err = m.Add("monitor", "hw:1", 0)
+	require.Nil(err)
+
+	broadcasterConn, err := p2p.NewServerConnectionWithOptions("broadcaster", p2p.ServerOptions{URL: url})
+	require.Nil(err)
+	defer broadcasterConn.Close()
+	var mutex sync.Mutex
+	subscribed := make([]string, 0)
+	admitted := true
+	connected := func(remoteID string) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return admitted && remoteID == "listener"
+	}
+	Serve(broadcasterConn, m, connected, func(remoteID string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		subscribed = append(subscribed, remoteID)
+	})
+	go broadcasterConn.Loop()
+
+	listenerConn, err := p2p.NewServerConnectionWithOptions("listener", p2p.ServerOptions{URL: url})
+	require.Nil(err)
+	defer listenerConn.Close()
+	replies := make(chan SourcesMessage, 10)
+	listenerConn.OnSignal(func(sp p2p.SignalPacket) {
+		if sp.Type != SignalSources {
+			return
+		}
+		msg := SourcesMessage{}
+		require.Nil(peer.DecodeJSON(sp.Data, &msg))
+		replies <- msg
+	})
+	go listenerConn.Loop()
+
+	request := func(sp p2p.SignalPacket) SourcesMessage {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		sp.To = "broadcaster"
+		require.Nil(listenerConn.SendSignal(ctx, sp))
+		select {
+		case msg := <-replies:
+			return msg
+		case <-ctx.Done():
+			require.Fail("no reply")
+		}
+		return SourcesMessage{}
+	}
+
+	msg := request(p2p.SignalPacket{Type: SignalListSources})
+	require.Len(msg.Sources, 2)
+	require.Empty(msg.Subscribed)
+	for _, info := range msg.Sources {
+		require.Empty(info.Device)
+		require.Zero(info.Port)
+	}
+
+	data, err := peer.EncodeJSON(SubscribeMessage{Sources: []string{"monitor"}})
+	require.Nil(err)
+	msg = request(p2p.SignalPacket{Type: SignalSubscribe, Data: data})
+	require.Empty(msg.Error)
+	require.Equal([]string{"monitor"}, msg.Subscribed)
+	mutex.Lock()
+	require.Equal([]string{"listener"}, subscribed)
+	mutex.Unlock()
+
+	data, err = peer.EncodeJSON(SubscribeMessage{Sources: []string{"nope"}})
+	require.Nil(err)
+	msg = request(p2p.SignalPacket{Type: SignalSubscribe, Data: data})
+	require.NotEmpty(msg.Error)
+	require.Equal([]string{"monitor"}, msg.Subscribed)
+
+	// Peers without a session learn nothing and subscribe to nothing
+	mutex.Lock()
+	admitted = false
+	mutex.Unlock()
+	msg = request(p2p.SignalPacket{Type: SignalListSources})
+	require.Equal(ErrNotConnected.Error(), msg.Error)
+	require.Empty(msg.Sources)
+	data, err = peer.EncodeJSON(SubscribeMessage{Sources: []string{"mic"}})
+	require.Nil(err)
+	msg = request(p2p.SignalPacket{Type: SignalSubscribe, Data: data})
+	require.Equal(ErrNotConnected.Error(), msg.Error)
+	require.Equal([]string{"monitor"}, m.Subscription("listener"))
+}
@@ -0,0 +1,303 @@
+// Package whip lets standard WebRTC tools reach media-peer over HTTP instead of
+// our signaling: WHEP players listen to our sources and WHIP encoders push
+// audio into them.
+package whip
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gurupras/dhwani_backend_p2p/peer"
+	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ContentTypeSDP     = "application/sdp"
+	ContentTypeTrickle = "application/trickle-ice-sdpfrag"
+	// maxBodySize bounds the offers and candidates we read
+	maxBodySize = 64 << 10
+)
+
+// Options configure a Server
+type Options struct {
+	// Ingest, if set, is called once an encoder called remoteID has been
+	// answered, before it may push audio into source. An error refuses it.
+	// Without Ingest there is no WHIP endpoint
+	Ingest func(remoteID, source string) error
+}
+
+// Server answers WHEP and WHIP offers with sessions of a PeerManager. The
+// bearer token of a request is its PIN for admission.
+type Server struct {
+	peers   *peer.PeerManager
+	options Options
+
+	mutex sync.Mutex
+	// ingests maps the ID of each WHIP session to the source it pushes into
+	ingests map[string]string
+}
+
+func NewServer(peers *peer.PeerManager, options Options) *Server {
+	return &Server{
+		peers:   peers,
+		options: options,
+		ingests: make(map[string]string),
+	}
+}
+
+// Handle serves WHEP at /whep and WHIP at /whip/<source> on mux. Sessions are
+// ended by a DELETE of the URL in the Location of the answer.
+func (s *Server) Handle(mux *http.ServeMux) {
+	mux.HandleFunc("/whep", s.serveWHEP)
+	mux.HandleFunc("/whep/", s.serveWHEP)
+	mux.HandleFunc("/whip/", s.serveWHIP)
+}
+
+func (s *Server) serveWHEP(w http.ResponseWriter, r *http.Request) {
+	allowCORS(w)
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/whep"), "/")
+	if id == "" {
+		s.serveEndpoint(w, r, "whep", "/whep/", nil)
+		return
+	}
+	s.serveResource(w, r, "whep", id, "")
+}
+
+func (s *Server) serveWHIP(w http.ResponseWriter, r *http.Request) {
+	allowCORS(w)
+	if s.options.Ingest == nil {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/whip/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		source := parts[0]
+		s.serveEndpoint(w, r, "whip", "/whip/"+source+"/", func(remoteID string) error {
+			if err := s.options.Ingest(remoteID, source); err != nil {
+				return err
+			}
+			s.addIngest(remoteID, source)
+			return nil
+		})
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		s.serveResource(w, r, "whip", parts[1], parts[0])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveEndpoint answers an offer POSTed by a new peer of kind. The session is
+// created at a resource under prefix. answered, if set, may still refuse it.
+func (s *Server) serveEndpoint(w http.ResponseWriter, r *http.Request, kind string, prefix string, answered func(remoteID string) error) {
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Allow", "OPTIONS, POST")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "OPTIONS, POST")
+		http.Error(w, "Offers must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hasContentType(r, ContentTypeSDP) {
+		http.Error(w, "Offers must be "+ContentTypeSDP, http.StatusUnsupportedMediaType)
+		return
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	remoteID, err := newID(kind)
+	if err != nil {
+		log.Errorf("Failed to create %v session ID: %v\n", kind, err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	req := peer.AdmissionRequest{RemoteID: remoteID, PIN: bearerToken(r)}
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: body}
+	answer, err := s.peers.Answer(r.Context(), req, offer)
+	if err != nil {
+		log.Warnf("Failed to answer %v offer from %v: %v\n", kind, r.RemoteAddr, err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	if answered != nil {
+		if err := answered(remoteID); err != nil {
+			s.peers.Close(remoteID)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+	log.Infof("Answered %v offer from %v as '%v'\n", kind, r.RemoteAddr, remoteID)
+	w.Header().Set("Content-Type", ContentTypeSDP)
+	w.Header().Set("Location", prefix+remoteID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer.SDP))
+}
+
+// serveResource trickles candidates to, or ends, the session of kind with
+// remoteID. WHIP sessions are only found under the source they push into
+func (s *Server) serveResource(w http.ResponseWriter, r *http.Request, kind string, remoteID string, source string) {
+	if !strings.HasPrefix(remoteID, kind+"-") {
+		http.NotFound(w, r)
+		return
+	}
+	if kind == "whip" && s.ingestSource(remoteID) != source {
+		http.NotFound(w, r)
+		return
+	}
+	if _, ok := s.peers.Session(remoteID); !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Allow", "OPTIONS, PATCH, DELETE")
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		if !hasContentType(r, ContentTypeTrickle) {
+			http.Error(w, "Candidates must be "+ContentTypeTrickle, http.StatusUnsupportedMediaType)
+			return
+		}
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		for _, candidate := range parseCandidates(body) {
+			if err := s.peers.AddCandidate(remoteID, candidate); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := s.peers.Close(remoteID); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		s.mutex.Lock()
+		delete(s.ingests, remoteID)
+		s.mutex.Unlock()
+		log.Infof("Ended %v session '%v'\n", kind, remoteID)
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.Header().Set("Allow", "OPTIONS, PATCH, DELETE")
+		http.Error(w, "Sessions may only be PATCHed or DELETEd", http.StatusMethodNotAllowed)
+	}
+}
+
+// addIngest records that remoteID pushes into source, forgetting sessions
+// that have ended since
+func (s *Server) addIngest(remoteID, source string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id := range s.ingests {
+		if _, ok := s.peers.Session(id); !ok {
+			delete(s.ingests, id)
+		}
+	}
+	s.ingests[remoteID] = source
+}
+
+// ingestSource returns the source the WHIP session remoteID pushes into
+func (s *Server) ingestSource(remoteID string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ingests[remoteID]
+}
+
+// errorStatus is the HTTP status for an error answering an offer
+func errorStatus(err error) int {
+	rejected := &peer.RejectedError{}
+	switch {
+	case errors.Is(err, peer.ErrTooManySessions):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &rejected):
+		return http.StatusForbidden
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusRequestTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// parseCandidates returns the candidates in an SDP fragment (RFC 8840)
+func parseCandidates(frag string) []webrtc.ICECandidateInit {
+	candidates := make([]webrtc.ICECandidateInit, 0)
+	index := -1
+	var mid *string
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			index++
+			mid = nil
+		case strings.HasPrefix(line, "a=mid:"):
+			value := strings.TrimPrefix(line, "a=mid:")
+			mid = &value
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a="), SDPMid: mid}
+			if index >= 0 {
+				lineIndex := uint16(index)
+				candidate.SDPMLineIndex = &lineIndex
+			}
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+func readBody(w http.ResponseWriter, r *http.Request) (string, bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return "", false
+	}
+	if len(body) > maxBodySize {
+		http.Error(w, "Body too large", http.StatusRequestEntityTooLarge)
+		return "", false
+	}
+	return string(body), true
+}
+
+func hasContentType(r *http.Request, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == contentType
+}
+
+// bearerToken returns the token of a "Bearer" Authorization header
+func bearerToken(r *http.Request) string {
+	fields := strings.Fields(r.Header.Get("Authorization"))
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "Bearer") {
+		return ""
+	}
+	return fields[1]
+}
+
+// allowCORS lets browser players on other origins use the endpoints
+func allowCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, POST, PATCH, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+}
+
+// newID returns a random ID for a session of kind
+func newID(kind string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v-%v", kind, hex.EncodeToString(b)), nil
+}
@@ -0,0 +1,180 @@
+package whip
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	p2p "github.com/gurupras/dhwani_backend_p2p"
+	"github.com/gurupras/dhwani_backend_p2p/peer"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/require"
+)
+
+type nopSignaler struct{}
+
+func (nopSignaler) SendSignal(ctx context.Context, sp p2p.SignalPacket) error {
+	return nil
+}
+
+func newTestServer(t *testing.T, options Options) (*httptest.Server, *peer.PeerManager) {
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "test")
+	require.Nil(t, err)
+	peers := peer.NewPeerManager(nopSignaler{}, peer.Config{
+		Tracks: func(remoteID string) []webrtc.TrackLocal {
+			return []webrtc.TrackLocal{track}
+		},
+		Admit: func(req peer.AdmissionRequest, decide func(err error)) {
+			if req.PIN != "1234" {
+				decide(errors.New("wrong PIN"))
+				return
+			}
+			decide(nil)
+		},
+	})
+	t.Cleanup(peers.CloseAll)
+	mux := http.NewServeMux()
+	NewServer(peers, options).Handle(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, peers
+}
+
+func newOffer(t *testing.T, direction webrtc.RTPTransceiverDirection) string {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		pc.Close()
+	})
+	if direction == webrtc.RTPTransceiverDirectionSendonly {
+		track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "encoder")
+		require.Nil(t, err)
+		_, err = pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: direction})
+		require.Nil(t, err)
+	} else {
+		_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: direction})
+		require.Nil(t, err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	require.Nil(t, err)
+	return offer.SDP
+}
+
+func send(t *testing.T, method string, url string, contentType string, token string, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.Nil(t, err)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		resp.Body.Close()
+	})
+	return resp
+}
+
+func TestWHEP(t *testing.T) {
+	require := require.New(t)
+
+	server, peers := newTestServer(t, Options{})
+	offer := newOffer(t, webrtc.RTPTransceiverDirectionRecvonly)
+
+	resp := send(t, http.MethodPost, server.URL+"/whep", "text/plain", "1234", offer)
+	require.Equal(http.StatusUnsupportedMediaType, resp.StatusCode)
+	resp = send(t, http.MethodPost, server.URL+"/whep", ContentTypeSDP, "", offer)
+	require.Equal(http.StatusForbidden, resp.StatusCode)
+	resp = send(t, http.MethodGet, server.URL+"/whep", "", "", "")
+	require.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp = send(t, http.MethodPost, server.URL+"/whep", ContentTypeSDP, "1234", offer)
+	require.Equal(http.StatusCreated, resp.StatusCode)
+	require.Equal(ContentTypeSDP, resp.Header.Get("Content-Type"))
+	require.Equal("Location", resp.Header.Get("Access-Control-Expose-Headers"))
+	location := resp.Header.Get("Location")
+	require.True(strings.HasPrefix(location, "/whep/whep-"))
+	answer, err := io.ReadAll(resp.Body)
+	require.Nil(err)
+	require.Contains(string(answer), "a=candidate:")
+	remoteID := strings.TrimPrefix(location, "/whep/")
+	session, ok := peers.Session(remoteID)
+	require.True(ok)
+	require.Len(session.PeerConnection.GetSenders(), 1)
+
+	frag := "a=ice-ufrag:abcd\r\na=ice-pwd:efghijklmnopqrstuvwxyz12\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\na=candidate:1 1 udp 2130706431 127.0.0.1 9 typ host\r\n"
+	resp = send(t, http.MethodPatch, server.URL+location, ContentTypeSDP, "", frag)
+	require.Equal(http.StatusUnsupportedMediaType, resp.StatusCode)
+	resp = send(t, http.MethodPatch, server.URL+location, ContentTypeTrickle, "", frag)
+	require.Equal(http.StatusNoContent, resp.StatusCode)
+
+	resp = send(t, http.MethodDelete, server.URL+location, "", "", "")
+	require.Equal(http.StatusOK, resp.StatusCode)
+	_, ok = peers.Session(remoteID)
+	require.False(ok)
+	resp = send(t, http.MethodDelete, server.URL+location, "", "", "")
+	require.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func TestWHIP(t *testing.T) {
+	require := require.New(t)
+
+	server, peers := newTestServer(t, Options{})
+	offer := newOffer(t, webrtc.RTPTransceiverDirectionSendonly)
+	resp := send(t, http.MethodPost, server.URL+"/whip/mic", ContentTypeSDP, "1234", offer)
+	require.Equal(http.StatusNotFound, resp.StatusCode)
+
+	ingests := make(map[string]string)
+	server, peers = newTestServer(t, Options{
+		Ingest: func(remoteID, source string) error {
+			if source == "busy" {
+				return errors.New("source 'busy' already exists")
+			}
+			ingests[remoteID] = source
+			return nil
+		},
+	})
+	resp = send(t, http.MethodPost, server.URL+"/whip/mic", ContentTypeSDP, "1234", offer)
+	require.Equal(http.StatusCreated, resp.StatusCode)
+	location := resp.Header.Get("Location")
+	require.True(strings.HasPrefix(location, "/whip/mic/whip-"))
+	remoteID := strings.TrimPrefix(location, "/whip/mic/")
+	require.Equal("mic", ingests[remoteID])
+	session, ok := peers.Session(remoteID)
+	require.True(ok)
+	for _, sender := range session.PeerConnection.GetSenders() {
+		require.Nil(sender.Track())
+	}
+	// WHEP and WHIP sessions are distinct resources
+	resp = send(t, http.MethodDelete, server.URL+"/whep/"+remoteID, "", "", "")
+	require.Equal(http.StatusNotFound, resp.StatusCode)
+	// Nor can another source's URL end it
+	resp = send(t, http.MethodDelete, server.URL+"/whip/other/"+remoteID, "", "", "")
+	require.Equal(http.StatusNotFound, resp.StatusCode)
+	resp = send(t, http.MethodDelete, server.URL+location, "", "", "")
+	require.Equal(http.StatusOK, resp.StatusCode)
+
+	resp = send(t, http.MethodPost, server.URL+"/whip/busy", ContentTypeSDP, "1234", offer)
+	require.Equal(http.StatusConflict, resp.StatusCode)
+	require.Empty(peers.Sessions())
+}
+
+func TestParseCandidates(t *testing.T) {
+	require := require.New(t)
+
+	frag := "a=ice-ufrag:abcd\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\na=candidate:1 1 udp 1 10.0.0.1 5000 typ host\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:1\r\na=candidate:2 1 udp 1 10.0.0.2 5000 typ host\r\na=end-of-candidates\r\n"
+	candidates := parseCandidates(frag)
+	require.Len(candidates, 2)
+	require.Equal("candidate:1 1 udp 1 10.0.0.1 5000 typ host", candidates[0].Candidate)
+	require.Equal("0", *candidates[0].SDPMid)
+	require.Equal(uint16(0), *candidates[0].SDPMLineIndex)
+	require.Equal("1", *candidates[1].SDPMid)
+	require.Equal(uint16(1), *candidates[1].SDPMLineIndex)
+	require.Empty(parseCandidates("a=ice-ufrag:abcd\r\n"))
+}